@@ -4,6 +4,7 @@ import (
 	"fmt"
 
 	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
@@ -30,3 +31,38 @@ func (e ErrOffsetOutOfRange) GRPCStatus() *status.Status {
 func (e ErrOffsetOutOfRange) Error() string {
 	return e.GRPCStatus().Err().Error()
 }
+
+// ErrOffsetTruncated is returned to streams reading an offset the log has
+// been truncated past. Unlike reads past the end, waiting won't help, the
+// stream has to start again from the lowest offset.
+type ErrOffsetTruncated struct {
+	Offset       uint64
+	LowestOffset uint64
+}
+
+func (e ErrOffsetTruncated) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.OutOfRange,
+		fmt.Sprintf("offset truncated: %d, lowest offset: %d", e.Offset, e.LowestOffset),
+	)
+	msg := fmt.Sprintf(
+		"the requested offset was truncated from the log: %d, the lowest offset is %d",
+		e.Offset,
+		e.LowestOffset,
+	)
+
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+
+	return std
+}
+
+func (e ErrOffsetTruncated) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/nireo/dilog/internal/agent"
+	"github.com/nireo/dilog/internal/config"
+	dlog "github.com/nireo/dilog/internal/log"
+)
+
+// agentFlags are the agent command's flags that don't map directly onto an
+// agent.Config field.
+type agentFlags struct {
+	startJoinAddrs    string
+	compression       string
+	staticPeers       string
+	staticPeerTags    peerTags
+	traceAlwaysSample string
+	otlpHeaders       string
+
+	serverTLS config.TLSConfig
+	peerTLS   config.TLSConfig
+}
+
+// runAgent runs an agent until it's interrupted. Every agent.Config option
+// has a flag except for APIKeys and GossipKeys, which would show the secrets
+// in the process list: use JWKSFile and GossipKeyringFile instead.
+func runAgent(args []string) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var (
+		c agent.Config
+		f agentFlags
+	)
+	fs := flag.NewFlagSet("agent", flag.ExitOnError)
+	fs.StringVar(&c.DataDir, "data-dir", filepath.Join(os.TempDir(), "dilog"), "directory to store the log and its state in")
+	fs.StringVar(&c.NodeName, "node-name", hostname, "unique name of the node in the cluster")
+	fs.StringVar(&c.BindAddr, "bind-addr", "127.0.0.1:8401", "address to gossip on")
+	fs.IntVar(&c.RPCPort, "rpc-port", 8400, "port to serve gRPC, HTTP and segments on")
+	fs.StringVar(&f.startJoinAddrs, "start-join-addrs", "", "comma separated gossip addresses of members to join")
+	fs.StringVar(&c.ACLModelFile, "acl-model-file", config.ACLModelFile, "casbin model the acl policy is written for")
+	fs.StringVar(&c.ACLPolicyFile, "acl-policy-file", config.ACLPolicyFile, "casbin acl policy")
+
+	fs.StringVar(&f.serverTLS.CertFile, "server-tls-cert-file", "", "certificate the server presents")
+	fs.StringVar(&f.serverTLS.KeyFile, "server-tls-key-file", "", "key of the server certificate")
+	fs.StringVar(&f.serverTLS.CAFile, "server-tls-ca-file", "", "CA client certificates are verified with")
+	fs.StringVar(&f.peerTLS.CertFile, "peer-tls-cert-file", "", "certificate presented to peers")
+	fs.StringVar(&f.peerTLS.KeyFile, "peer-tls-key-file", "", "key of the peer certificate")
+	fs.StringVar(&f.peerTLS.CAFile, "peer-tls-ca-file", "", "CA peers' certificates are verified with")
+
+	fs.Uint64Var(&c.MaxStoreBytes, "max-store-bytes", 0, "size of a segment's store before the log moves on to a new segment")
+	fs.Uint64Var(&c.MaxIndexBytes, "max-index-bytes", 0, "size of a segment's index before the log moves on to a new segment")
+	fs.StringVar(&f.compression, "compression", "none", "codec new segments are compressed with: none, gzip, snappy or zstd")
+	fs.StringVar(&c.EncryptionKeyFile, "encryption-key-file", "", "file of keys new segments are encrypted with")
+	fs.Uint64Var(&c.IndexInterval, "index-interval", 0, "store bytes between index entries, 0 indexes every record")
+	fs.Uint64Var(&c.AuditMaxBytes, "audit-max-bytes", 0, "size the audit log's oldest entries are removed past, 0 keeps them")
+	fs.DurationVar(&c.AuditMaxAge, "audit-max-age", 0, "age audit entries are removed past, 0 keeps them")
+
+	fs.StringVar(&c.JWKSFile, "jwks-file", "", "JSON web key set bearer tokens are verified with, enables token authentication")
+	fs.StringVar(&c.JWTIssuer, "jwt-issuer", "", "issuer bearer tokens must have")
+	fs.StringVar(&c.JWTAudience, "jwt-audience", "", "audience bearer tokens must have")
+	fs.StringVar(&c.TLSIdentity, "tls-identity", "", "client certificate name used as the subject: cn, dns or spiffe")
+	fs.StringVar(&c.SPIFFETrustDomain, "spiffe-trust-domain", "", "trust domain SPIFFE IDs must belong to")
+	fs.StringVar(&c.QuotaFile, "quota-file", "", "file of produce and consume rate limits per subject")
+
+	fs.Float64Var(&c.TraceSampleRate, "trace-sample-rate", 0, "fraction of calls traced, negative traces only the always sampled methods")
+	fs.StringVar(&f.traceAlwaysSample, "trace-always-sample", "", "comma separated methods that are always traced, the produce methods by default")
+	fs.StringVar(&c.OTLPEndpoint, "otlp-endpoint", "", "OpenTelemetry collector URL spans are sent to")
+	fs.StringVar(&f.otlpHeaders, "otlp-headers", "", "comma separated key=value headers sent to the collector")
+
+	fs.IntVar(&c.ReplicationFactor, "replication-factor", 0, "number of nodes each log is kept on, 0 keeps every log on every node")
+	fs.Uint64Var(&c.ReplicationLagThreshold, "replication-lag-threshold", 0, "records a peer can be ahead before a warning is logged, 0 disables it")
+
+	fs.StringVar(&c.Discovery, "discovery", agent.DiscoverySerf, "how peers are found: serf, static or dns")
+	fs.StringVar(&f.staticPeers, "static-peers", "", "comma separated name=rpc-addr of every node, with static discovery")
+	fs.Var(&f.staticPeerTags, "static-peer-tags", "a static peer's tags as name:key=value,..., can be repeated")
+	fs.StringVar(&c.DNSName, "dns-name", "", "SRV record listing the nodes, with dns discovery")
+	fs.DurationVar(&c.DNSInterval, "dns-interval", 0, "how often the SRV record is looked up")
+	fs.StringVar(&c.GossipKeyringFile, "gossip-keyring-file", "", "JSON list of base64 keys gossip is encrypted with, kept up to date as keys are rotated")
+
+	fs.StringVar(&c.Role, "role", "", "role advertised to the other members")
+	fs.StringVar(&c.Zone, "zone", "", "zone advertised to the other members, replicas are spread across zones")
+	fs.StringVar(&c.Rack, "rack", "", "rack advertised to the other members")
+	fs.StringVar(&c.HTTPAddr, "http-addr", "", "HTTP address advertised to the other members, the RPC address by default")
+	fs.Parse(args)
+
+	if f.startJoinAddrs != "" {
+		c.StartJoinAddrs = strings.Split(f.startJoinAddrs, ",")
+	}
+
+	if f.traceAlwaysSample != "" {
+		c.TraceAlwaysSample = strings.Split(f.traceAlwaysSample, ",")
+	}
+
+	if c.OTLPHeaders, err = keyValues(f.otlpHeaders); err != nil {
+		log.Fatalf("otlp-headers: %s", err)
+	}
+
+	if c.StaticPeers, err = keyValues(f.staticPeers); err != nil {
+		log.Fatalf("static-peers: %s", err)
+	}
+	c.StaticPeerTags = f.staticPeerTags
+
+	c.Compression, err = dlog.ParseCodec(f.compression)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := os.MkdirAll(c.DataDir, 0755); err != nil {
+		log.Fatal(err)
+	}
+
+	c.ServerTLSFiles = tlsFiles(f.serverTLS, true)
+	c.PeerTLSFiles = tlsFiles(f.peerTLS, false)
+
+	a, err := agent.New(c)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+	<-sigc
+
+	if err := a.Shutdown(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// tlsFiles returns the TLS files given for the agent to load and reload as
+// they're renewed, or nil if there are none.
+func tlsFiles(c config.TLSConfig, server bool) *config.TLSConfig {
+	if c.CertFile == "" && c.KeyFile == "" && c.CAFile == "" {
+		return nil
+	}
+
+	c.Server = server
+	return &c
+}
+
+// keyValues parses comma separated key=value pairs.
+func keyValues(s string) (map[string]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	m := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		i := strings.Index(kv, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("expected key=value: %q", kv)
+		}
+		m[kv[:i]] = kv[i+1:]
+	}
+
+	return m, nil
+}
+
+// peerTags is a flag of static peers' tags, given once per peer as
+// name:key=value,...
+type peerTags map[string]map[string]string
+
+func (p *peerTags) String() string {
+	return fmt.Sprint(map[string]map[string]string(*p))
+}
+
+func (p *peerTags) Set(s string) error {
+	i := strings.Index(s, ":")
+	if i <= 0 {
+		return fmt.Errorf("expected name:key=value,...: %q", s)
+	}
+
+	tags, err := keyValues(s[i+1:])
+	if err != nil {
+		return err
+	}
+
+	if *p == nil {
+		*p = make(peerTags)
+	}
+	(*p)[s[:i]] = tags
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/nireo/dilog/internal/config"
+)
+
+const usage = `usage: dilog <command> [flags]
+
+commands:
+  agent    run a node
+  certs    generate a development CA and certificates
+`
+
+func main() {
+	log.SetFlags(0)
+
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	switch os.Args[1] {
+	case "agent":
+		runAgent(os.Args[2:])
+	case "certs":
+		certs(os.Args[2:])
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command: %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+}
+
+// certs writes a CA, server, root client and nobody client certificate to
+// the config directory, so the tests and development setups don't need
+// cfssl.
+func certs(args []string) {
+	fs := flag.NewFlagSet("certs", flag.ExitOnError)
+	dir := fs.String("dir", config.Dir(), "directory to write the certificates to")
+	hosts := fs.String(
+		"hosts",
+		strings.Join(config.DefaultCertHosts, ","),
+		"comma separated names and addresses the server certificate is valid for",
+	)
+	validity := fs.Duration("validity", config.DefaultCertValidity, "how long the certificates are valid")
+	force := fs.Bool("force", false, "overwrite an existing CA")
+	fs.Parse(args)
+
+	err := config.GenerateCerts(config.CertsConfig{
+		Dir:      *dir,
+		Hosts:    strings.Split(*hosts, ","),
+		Validity: *validity,
+		Force:    *force,
+	})
+	if err == config.ErrCertsExist {
+		log.Fatalf("%s: %s, use -force to replace them", *dir, err)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("wrote certificates to %s", *dir)
+}
@@ -3,13 +3,27 @@ package agent
 import (
 	"crypto/tls"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
+	"net/http"
+	"os"
+	"path/filepath"
 	"sync"
+	"time"
 
+	ocprom "contrib.go.opencensus.io/exporter/prometheus"
+	"github.com/nireo/dilog/internal/audit"
 	"github.com/nireo/dilog/internal/auth"
+	"github.com/nireo/dilog/internal/config"
 	"github.com/nireo/dilog/internal/discovery"
 	"github.com/nireo/dilog/internal/log"
+	"github.com/nireo/dilog/internal/quota"
 	"github.com/nireo/dilog/internal/server"
+	"github.com/nireo/dilog/internal/tracing"
+	"github.com/soheilhy/cmux"
+	"go.opencensus.io/plugin/ocgrpc"
+	"go.opencensus.io/stats/view"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
@@ -18,6 +32,8 @@ import (
 )
 
 type Config struct {
+	// ServerTLSConfig and PeerTLSConfig can come from a
+	// config.TLSReloader so that renewed certificates are picked up.
 	ServerTLSConfig *tls.Config
 	PeerTLSConfig   *tls.Config
 	DataDir         string
@@ -27,14 +43,125 @@ type Config struct {
 	StartJoinAddrs  []string
 	ACLModelFile    string
 	ACLPolicyFile   string
+
+	// ServerTLSFiles and PeerTLSFiles set up ServerTLSConfig and
+	// PeerTLSConfig from their files instead, reloading them whenever the
+	// files change.
+	ServerTLSFiles *config.TLSConfig
+	PeerTLSFiles   *config.TLSConfig
+
+	// MaxStoreBytes and MaxIndexBytes bound the size of each segment's
+	// files, the log moves on to a new segment once either is full. They
+	// default to log.NewLog's defaults.
+	MaxStoreBytes uint64
+	MaxIndexBytes uint64
+	// Compression is the codec records appended to new segments are
+	// compressed with, none by default.
+	Compression log.Codec
+	// EncryptionKeyFile encrypts records appended to new segments with the
+	// newest key in it, see log.FileKeyProvider for its format. Older keys
+	// have to stay in the file for as long as segments use them.
+	EncryptionKeyFile string
+	// IndexInterval is the number of store bytes written between index
+	// entries, zero indexes every record.
+	IndexInterval uint64
+
+	// AuditMaxBytes and AuditMaxAge bound how much of the audit log is
+	// kept, by its size and by the age of its entries. Zero keeps all of it.
+	AuditMaxBytes uint64
+	AuditMaxAge   time.Duration
+
+	// JWKSFile enables bearer token authentication with the JSON web keys in
+	// it, checking the tokens' JWTIssuer and JWTAudience if set. APIKeys maps
+	// static API keys to the subjects they authenticate as. Either is tried
+	// before the client certificate.
+	JWKSFile    string
+	JWTIssuer   string
+	JWTAudience string
+	APIKeys     map[string]string
+	// TLSIdentity selects the client certificate's name used as its
+	// subject: auth.IdentityCommonName (the default), auth.IdentityDNSName
+	// or auth.IdentitySPIFFE, whose IDs can be restricted to
+	// SPIFFETrustDomain.
+	TLSIdentity       string
+	SPIFFETrustDomain string
+	// QuotaFile limits how fast each subject may produce and consume, it's
+	// reloaded whenever it changes. See quota.Config for its format. Peers
+	// replicate as the subject of their certificate, which shouldn't be
+	// limited.
+	QuotaFile string
+	// TraceSampleRate is the fraction of calls traced, it defaults to
+	// tracing.DefaultSampleRate and a negative rate only traces the
+	// TraceAlwaysSample methods. Those default to
+	// tracing.DefaultAlwaysSampled, the produce methods.
+	TraceSampleRate   float64
+	TraceAlwaysSample []string
+	// OTLPEndpoint exports the traced calls' spans to the OpenTelemetry
+	// collector at this URL, such as http://localhost:4318, with OTLP over
+	// HTTP. OTLPHeaders are sent with each export.
+	OTLPEndpoint string
+	OTLPHeaders  map[string]string
+	// ReplicationLagThreshold is how many records a peer can be ahead of
+	// this node before a warning is logged, zero disables the warning.
+	ReplicationLagThreshold uint64
+	// ReplicationFactor is the number of nodes each node's log is kept on,
+	// zero keeps every log on every node.
+	ReplicationFactor int
+
+	// Discovery selects how the agent finds its peers: DiscoverySerf (the
+	// default) gossips on BindAddr, DiscoveryStatic uses StaticPeers and
+	// DiscoveryDNS looks up the DNSName SRV record every DNSInterval, taking
+	// each target's tags from its TXT records. StaticPeerTags are the static
+	// peers' tags, such as their zones, which serf would have gossiped.
+	Discovery      string
+	StaticPeers    map[string]string
+	StaticPeerTags map[string]map[string]string
+	DNSName        string
+	DNSInterval    time.Duration
+
+	// Role, Zone, Rack and HTTPAddr are advertised to the other members
+	// along with the RPC address and Version. Role defaults to DefaultRole
+	// and HTTPAddr to the RPC address, where HTTP is served too.
+	Role     string
+	Zone     string
+	Rack     string
+	HTTPAddr string
+
+	// GossipKeys are base64 encoded keys serf gossip is encrypted with, the
+	// first one is used for encrypting. GossipKeyringFile persists key
+	// rotations and takes precedence over GossipKeys once it exists.
+	GossipKeys        []string
+	GossipKeyringFile string
 }
 
+const (
+	DiscoverySerf   = "serf"
+	DiscoveryStatic = "static"
+	DiscoveryDNS    = "dns"
+)
+
 type Agent struct {
 	Config
+	mux        cmux.CMux
 	log        *log.Log
 	server     *grpc.Server
-	membership *discovery.Membership
+	httpServer *http.Server
+	membership discovery.Membership
 	replicator *log.Replicator
+	authorizer *auth.Authorizer
+	audit      *audit.Log
+	quotas     *quota.Quotas
+	metrics    *ocprom.Exporter
+	exporter   *tracing.OTLPExporter
+	// tlsReloaders keep the TLS configs set up from files up to date.
+	tlsReloaders []*config.TLSReloader
+	// serverConfig is shared by the gRPC server and the segment protocol.
+	serverConfig *server.Config
+
+	decommissioning int32
+	// produceMu is held for reading by appends and for writing while
+	// decommissioning stops produces.
+	produceMu sync.RWMutex
 
 	shutdown     bool
 	shutdowns    chan struct{}
@@ -57,8 +184,16 @@ func New(config Config) (*Agent, error) {
 
 	setup := []func() error{
 		a.setupLogger,
+		a.setupTLS,
+		a.setupTracing,
 		a.setupLog,
+		a.setupAudit,
+		a.setupReplicator,
+		a.setupMux,
 		a.setupServer,
+		a.setupSegments,
+		a.setupMetrics,
+		a.setupHTTP,
 		a.setupMembership,
 	}
 
@@ -68,9 +203,144 @@ func New(config Config) (*Agent, error) {
 		}
 	}
 
+	go a.serve()
 	return a, nil
 }
 
+// setupTLS sets up the TLS configs given as files, watching the files for
+// renewed certificates.
+func (a *Agent) setupTLS() error {
+	for _, tc := range []struct {
+		files  *config.TLSConfig
+		config **tls.Config
+	}{
+		{a.Config.ServerTLSFiles, &a.Config.ServerTLSConfig},
+		{a.Config.PeerTLSFiles, &a.Config.PeerTLSConfig},
+	} {
+		if tc.files == nil {
+			continue
+		}
+
+		r, err := config.NewTLSReloader(*tc.files)
+		if err != nil {
+			return err
+		}
+
+		if err := r.Watch(); err != nil {
+			return err
+		}
+
+		a.tlsReloaders = append(a.tlsReloaders, r)
+		*tc.config = r.TLSConfig()
+	}
+
+	return nil
+}
+
+// closeTLS stops watching the TLS files.
+func (a *Agent) closeTLS() error {
+	for _, r := range a.tlsReloaders {
+		if err := r.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setupMux listens on the RPC address and routes each connection by its
+// first bytes to the segment protocol, gRPC or HTTP. With TLS, connections
+// are decrypted before they're routed.
+func (a *Agent) setupMux() error {
+	rpcAddr, err := a.RPCAddr()
+	if err != nil {
+		return err
+	}
+
+	ln, err := net.Listen("tcp", rpcAddr)
+	if err != nil {
+		return err
+	}
+
+	if a.Config.ServerTLSConfig != nil {
+		ln = tls.NewListener(ln, withNextProtos(a.Config.ServerTLSConfig, "h2", "http/1.1"))
+	}
+
+	a.mux = cmux.New(ln)
+	return nil
+}
+
+// withNextProtos returns a copy of the config that negotiates protos, along
+// with the configs its GetConfigForClient returns, like the ones reloading
+// the CA does.
+func withNextProtos(tlsConfig *tls.Config, protos ...string) *tls.Config {
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.NextProtos = protos
+
+	if get := tlsConfig.GetConfigForClient; get != nil {
+		tlsConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			c, err := get(hello)
+			if c == nil || err != nil {
+				return c, err
+			}
+
+			c = c.Clone()
+			c.NextProtos = protos
+			return c, nil
+		}
+	}
+
+	return tlsConfig
+}
+
+func (a *Agent) setupSegments() error {
+	ln := a.mux.Match(func(r io.Reader) bool {
+		b := make([]byte, 1)
+		if _, err := r.Read(b); err != nil {
+			return false
+		}
+		return b[0] == server.SegmentProtocol
+	})
+
+	go func() {
+		_ = server.ServeSegments(ln, a.serverConfig)
+	}()
+
+	return nil
+}
+
+// setupHTTP serves HTTP/1.1 requests: health checks and metrics for
+// Prometheus to scrape.
+func (a *Agent) setupHTTP() error {
+	ln := a.mux.Match(cmux.HTTP1Fast())
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if a.Decommissioning() {
+			http.Error(w, "decommissioning", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	mux.Handle("/metrics", a.metrics)
+
+	a.httpServer = &http.Server{Handler: mux}
+	go func() {
+		if err := a.httpServer.Serve(ln); err != nil && err != http.ErrServerClosed {
+			_ = a.Shutdown()
+		}
+	}()
+
+	return nil
+}
+
+func (a *Agent) serve() error {
+	if err := a.mux.Serve(); err != nil {
+		_ = a.Shutdown()
+		return err
+	}
+	return nil
+}
+
 func (a *Agent) setupLogger() error {
 	logger, err := zap.NewDevelopment()
 	if err != nil {
@@ -82,57 +352,182 @@ func (a *Agent) setupLogger() error {
 }
 
 func (a *Agent) setupLog() error {
-	var err error
-	a.log, err = log.NewLog(
-		a.Config.DataDir,
-		log.Config{},
-	)
+	if err := view.Register(log.Views...); err != nil {
+		return err
+	}
+
+	logDir := filepath.Join(a.Config.DataDir, "log")
+	if err := os.MkdirAll(logDir, 0755); err != nil {
+		return err
+	}
+
+	if err := migrateLog(a.Config.DataDir, logDir); err != nil {
+		return err
+	}
 
+	logConfig, err := a.logConfig()
+	if err != nil {
+		return err
+	}
+
+	a.log, err = log.NewLog(logDir, logConfig)
 	return err
 }
 
-func (a *Agent) setupServer() error {
-	authorizer := auth.New(
-		a.Config.ACLModelFile,
-		a.Config.ACLPolicyFile,
-	)
+// migrateLog moves the segments of a log kept in the data dir itself, as
+// before the data dir held the audit log and replication state too, into
+// the log's own directory.
+func migrateLog(dataDir, logDir string) error {
+	files, err := ioutil.ReadDir(dataDir)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		ext := filepath.Ext(file.Name())
+		if file.IsDir() || (ext != ".store" && ext != ".index") {
+			continue
+		}
 
-	serverConfig := &server.Config{
-		CommitLog:  a.log,
-		Authorizer: authorizer,
+		err := os.Rename(
+			filepath.Join(dataDir, file.Name()),
+			filepath.Join(logDir, file.Name()),
+		)
+		if err != nil {
+			return err
+		}
 	}
-	var opts []grpc.ServerOption
-	if a.Config.ServerTLSConfig != nil {
-		creds := credentials.NewTLS(a.Config.ServerTLSConfig)
-		opts = append(opts, grpc.Creds(creds))
+
+	return nil
+}
+
+// logConfig returns the configuration of the log's segments.
+func (a *Agent) logConfig() (log.Config, error) {
+	c := log.Config{}
+	c.Segment.MaxStoreBytes = a.Config.MaxStoreBytes
+	c.Segment.MaxIndexBytes = a.Config.MaxIndexBytes
+	c.Segment.Compression = a.Config.Compression
+	c.Segment.IndexInterval = a.Config.IndexInterval
+
+	if a.Config.EncryptionKeyFile != "" {
+		keys, err := log.NewFileKeyProvider(a.Config.EncryptionKeyFile)
+		if err != nil {
+			return log.Config{}, err
+		}
+		c.Segment.Encryption = keys
 	}
 
+	return c, nil
+}
+
+// setupAudit opens the audit log, which is kept apart from the log so it
+// isn't replicated.
+func (a *Agent) setupAudit() error {
 	var err error
-	a.server, err = server.NewGRPCServer(serverConfig, opts...)
-	if err != nil {
+	a.audit, err = audit.New(filepath.Join(a.Config.DataDir, "audit"), audit.Config{
+		MaxBytes: a.Config.AuditMaxBytes,
+		MaxAge:   a.Config.AuditMaxAge,
+	})
+	return err
+}
+
+func (a *Agent) setupServer() error {
+	a.authorizer = auth.New(
+		a.Config.ACLModelFile,
+		a.Config.ACLPolicyFile,
+	)
+	a.authorizer.SetAudit(a.audit)
+	if err := a.authorizer.Watch(); err != nil {
 		return err
 	}
 
-	rpcAddr, err := a.RPCAddr()
+	authenticators, err := a.authenticators()
 	if err != nil {
 		return err
 	}
 
-	ln, err := net.Listen("tcp", rpcAddr)
+	if a.Config.QuotaFile != "" {
+		a.quotas, err = quota.New(a.Config.QuotaFile)
+		if err != nil {
+			return err
+		}
+
+		if err := a.quotas.Watch(); err != nil {
+			return err
+		}
+	}
+
+	a.serverConfig = &server.Config{
+		CommitLog:      produceLog{Log: a.log, agent: a},
+		Authorizer:     a.authorizer,
+		Authenticators: authenticators,
+		Audit:          a.audit,
+		Replication:    a.replicator,
+		Decommissioner: a,
+		Cluster:        a,
+		GossipKeyring:  a,
+		NodeName:       a.Config.NodeName,
+	}
+	if a.quotas != nil {
+		a.serverConfig.Quotas = a.quotas
+	}
+
+	var opts []grpc.ServerOption
+	if a.Config.ServerTLSConfig != nil {
+		creds := server.MuxCredentials(a.Config.ServerTLSConfig)
+		opts = append(opts, grpc.Creds(creds))
+	}
+
+	a.server, err = server.NewGRPCServer(a.serverConfig, opts...)
 	if err != nil {
 		return err
 	}
 
+	ln := a.mux.MatchWithWriters(
+		cmux.HTTP2MatchHeaderFieldSendSettings("content-type", "application/grpc"),
+	)
 	go func() {
 		if err := a.server.Serve(ln); err != nil {
 			_ = a.Shutdown()
 		}
 	}()
 
-	return err
+	return nil
 }
 
-func (a *Agent) setupMembership() error {
+// authenticators returns the configured authenticators, bearer tokens and
+// API keys first so they take precedence over the client certificate.
+func (a *Agent) authenticators() ([]server.Authenticator, error) {
+	var authenticators []server.Authenticator
+	if a.Config.JWKSFile != "" {
+		jwt, err := auth.NewJWT(auth.JWTConfig{
+			JWKSFile: a.Config.JWKSFile,
+			Issuer:   a.Config.JWTIssuer,
+			Audience: a.Config.JWTAudience,
+		})
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, jwt)
+	}
+
+	if len(a.Config.APIKeys) != 0 {
+		authenticators = append(authenticators, auth.NewAPIKeys(a.Config.APIKeys))
+	}
+
+	switch a.Config.TLSIdentity {
+	case auth.IdentityCommonName, auth.IdentityDNSName, auth.IdentitySPIFFE, "":
+	default:
+		return nil, fmt.Errorf("unknown tls identity: %q", a.Config.TLSIdentity)
+	}
+
+	return append(authenticators, auth.MTLS{
+		Identity:    a.Config.TLSIdentity,
+		TrustDomain: a.Config.SPIFFETrustDomain,
+	}), nil
+}
+
+func (a *Agent) setupReplicator() error {
 	rpcAddr, err := a.Config.RPCAddr()
 	if err != nil {
 		return err
@@ -145,25 +540,64 @@ func (a *Agent) setupMembership() error {
 		))
 	}
 
-	conn, err := grpc.Dial(rpcAddr, opts...)
+	// the local produces of replicated records are traced as children of
+	// the replicator's spans.
+	conn, err := grpc.Dial(
+		rpcAddr,
+		append(opts, grpc.WithStatsHandler(&ocgrpc.ClientHandler{}))...,
+	)
 	if err != nil {
 		return err
 	}
 
 	client := api.NewLogClient(conn)
 	a.replicator = &log.Replicator{
-		DialOptions: opts,
-		LocalServer: client,
+		DialOptions:       opts,
+		LocalServer:       client,
+		NodeName:          a.Config.NodeName,
+		Zone:              a.Config.Zone,
+		DataDir:           a.Config.DataDir,
+		Log:               a.log,
+		LagThreshold:      a.Config.ReplicationLagThreshold,
+		ReplicationFactor: a.Config.ReplicationFactor,
 	}
 
-	a.membership, err = discovery.New(a.replicator, discovery.Config{
-		NodeName: a.Config.NodeName,
-		BindAddr: a.Config.BindAddr,
-		Tags: map[string]string{
-			"rpc_addr": rpcAddr,
-		},
-		StartJoinAddrs: a.Config.StartJoinAddrs,
-	})
+	return nil
+}
+
+func (a *Agent) setupMembership() error {
+	tags, err := a.tags()
+	if err != nil {
+		return err
+	}
+
+	switch a.Config.Discovery {
+	case DiscoverySerf, "":
+		a.membership, err = discovery.NewSerf(a.replicator, discovery.Config{
+			NodeName:       a.Config.NodeName,
+			BindAddr:       a.Config.BindAddr,
+			Tags:           tags,
+			StartJoinAddrs: a.Config.StartJoinAddrs,
+			EncryptKeys:    a.Config.GossipKeys,
+			KeyringFile:    a.Config.GossipKeyringFile,
+		})
+	case DiscoveryStatic:
+		a.membership, err = discovery.NewStatic(a.replicator, discovery.StaticConfig{
+			NodeName: a.Config.NodeName,
+			Tags:     tags,
+			Peers:    a.Config.StaticPeers,
+			PeerTags: a.Config.StaticPeerTags,
+		})
+	case DiscoveryDNS:
+		a.membership, err = discovery.NewDNS(a.replicator, discovery.DNSConfig{
+			NodeName: a.Config.NodeName,
+			Tags:     tags,
+			Name:     a.Config.DNSName,
+			Interval: a.Config.DNSInterval,
+		})
+	default:
+		err = fmt.Errorf("unknown discovery backend: %q", a.Config.Discovery)
+	}
 
 	return err
 }
@@ -185,7 +619,18 @@ func (a *Agent) Shutdown() error {
 			a.server.GracefulStop()
 			return nil
 		},
+		a.httpServer.Close,
+		a.authorizer.Close,
+		func() error {
+			if a.quotas == nil {
+				return nil
+			}
+			return a.quotas.Close()
+		},
+		a.closeTracing,
+		a.closeTLS,
 		a.log.Close,
+		a.audit.Close,
 	}
 
 	for _, fn := range shutdown {
@@ -3,19 +3,41 @@ package agent_test
 import (
 	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
 	"fmt"
 	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
 	"testing"
 	"time"
 
 	api "github.com/nireo/dilog/api/v1"
 	"github.com/nireo/dilog/internal/agent"
 	"github.com/nireo/dilog/internal/config"
+	"github.com/nireo/dilog/internal/log"
+	"github.com/nireo/dilog/internal/server"
+	"github.com/stretchr/testify/require"
 	"github.com/travisjeffery/go-dynaport"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 )
 
 func client(t *testing.T, agent *agent.Agent, tlsConfig *tls.Config) api.LogClient {
@@ -35,20 +57,26 @@ func client(t *testing.T, agent *agent.Agent, tlsConfig *tls.Config) api.LogClie
 	return client
 }
 
-func TestAgent(t *testing.T) {
+func setupAgents(t *testing.T, n int, fn func(*agent.Config)) (
+	agents []*agent.Agent,
+	peerTLSConfig *tls.Config,
+	teardown func(),
+) {
+	t.Helper()
+
 	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
 		CertFile:      config.ServerCertFile,
 		KeyFile:       config.ServerKeyFile,
 		CAFile:        config.CAFile,
 		Server:        true,
-		ServerAddress: "127.0.01",
+		ServerAddress: "127.0.0.1",
 	})
 
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	peerTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+	peerTLSConfig, err = config.SetupTLSConfig(config.TLSConfig{
 		CertFile:      config.RootClientCertFile,
 		KeyFile:       config.RootClientKeyFile,
 		CAFile:        config.CAFile,
@@ -60,10 +88,9 @@ func TestAgent(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	var agents []*agent.Agent
-	for i := 0; i < 3; i++ {
+	for i := 0; i < n; i++ {
 		ports := dynaport.Get(2)
-		bindAddr := fmt.Sprintf("%s:%d", "127.0.01", ports[0])
+		bindAddr := fmt.Sprintf("%s:%d", "127.0.0.1", ports[0])
 		rpcPort := ports[1]
 
 		dataDir, err := ioutil.TempDir("", "agent-test-log")
@@ -76,7 +103,7 @@ func TestAgent(t *testing.T) {
 			startJoinAddrs = append(startJoinAddrs, agents[0].Config.BindAddr)
 		}
 
-		agent, err := agent.New(agent.Config{
+		cfg := agent.Config{
 			NodeName:        fmt.Sprintf("%d", i),
 			StartJoinAddrs:  startJoinAddrs,
 			BindAddr:        bindAddr,
@@ -86,7 +113,12 @@ func TestAgent(t *testing.T) {
 			ACLPolicyFile:   config.ACLPolicyFile,
 			ServerTLSConfig: serverTLSConfig,
 			PeerTLSConfig:   peerTLSConfig,
-		})
+		}
+		if fn != nil {
+			fn(&cfg)
+		}
+
+		agent, err := agent.New(cfg)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -94,7 +126,7 @@ func TestAgent(t *testing.T) {
 		agents = append(agents, agent)
 	}
 
-	defer func() {
+	return agents, peerTLSConfig, func() {
 		for _, agent := range agents {
 			err := agent.Shutdown()
 			if err != nil {
@@ -105,7 +137,49 @@ func TestAgent(t *testing.T) {
 				t.Fatal(err)
 			}
 		}
-	}()
+	}
+}
+
+func clients(t *testing.T, agents []*agent.Agent, tlsConfig *tls.Config) []api.LogClient {
+	var clients []api.LogClient
+	for _, agent := range agents {
+		clients = append(clients, client(t, agent, tlsConfig))
+	}
+	return clients
+}
+
+// caughtUp reports whether every agent replicates every other one and has
+// replicated their logs in full.
+func caughtUp(agents []*agent.Agent, clients []api.LogClient) bool {
+	ctx := context.Background()
+	next := make(map[string]uint64)
+	for i, c := range clients {
+		res, err := c.GetOffsets(ctx, &api.GetOffsetsRequest{})
+		if err != nil {
+			return false
+		}
+		next[agents[i].Config.NodeName] = res.NextOffset
+	}
+
+	for _, c := range clients {
+		res, err := c.ReplicationStatus(ctx, &api.ReplicationStatusRequest{})
+		if err != nil || len(res.Peers) != len(agents)-1 {
+			return false
+		}
+
+		for _, peer := range res.Peers {
+			if peer.State != log.PeerReplicating || peer.ReplicatedOffset != next[peer.Name] {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+func TestAgent(t *testing.T) {
+	agents, peerTLSConfig, teardown := setupAgents(t, 3, nil)
+	defer teardown()
 
 	time.Sleep(3 * time.Second)
 
@@ -147,4 +221,1086 @@ func TestAgent(t *testing.T) {
 	if !bytes.Equal(consumeResponse.Record.Value, []byte("foo")) {
 		t.Fatal("values are not equal")
 	}
+
+	replication, err := followerClient.ReplicationStatus(
+		context.Background(),
+		&api.ReplicationStatusRequest{},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(replication.Peers) != len(agents)-1 {
+		t.Fatalf("got %d peers, want: %d", len(replication.Peers), len(agents)-1)
+	}
+
+	for _, peer := range replication.Peers {
+		if peer.State != "replicating" {
+			t.Errorf("peer %s: got state: %s, want: replicating", peer.Name, peer.State)
+		}
+
+		if peer.Lag != 0 {
+			t.Errorf("peer %s: got lag: %d, want: 0", peer.Name, peer.Lag)
+		}
+	}
+}
+
+func TestAgentReplicatesOnce(t *testing.T) {
+	agents, peerTLSConfig, teardown := setupAgents(t, 3, nil)
+	defer teardown()
+
+	clients := clients(t, agents, peerTLSConfig)
+	require.Eventually(t, func() bool {
+		return caughtUp(agents, clients)
+	}, 10*time.Second, 100*time.Millisecond)
+
+	// produce a record on every node, each should end up on all of them
+	// exactly once instead of bouncing between the nodes.
+	want := make(map[string]int)
+	for i, c := range clients {
+		value := fmt.Sprintf("record from %d", i)
+		want[value] = 1
+
+		_, err := c.Produce(
+			context.Background(),
+			&api.ProduceRequest{
+				Record: &api.Record{
+					Value: []byte(value),
+				},
+			},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// every record has been applied everywhere once the nodes have
+	// replicated each other's logs in full.
+	require.Eventually(t, func() bool {
+		return caughtUp(agents, clients)
+	}, 10*time.Second, 100*time.Millisecond)
+
+	for i, c := range clients {
+		got := make(map[string]int)
+		for off := uint64(0); ; off++ {
+			res, err := c.Consume(context.Background(), &api.ConsumeRequest{
+				Offset: off,
+			})
+			if grpc.Code(err) == grpc.Code(api.ErrOffsetOutOfRange{}.GRPCStatus().Err()) {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got[string(res.Record.Value)]++
+		}
+
+		if !reflect.DeepEqual(want, got) {
+			t.Errorf("node %d: got records: %v, want: %v", i, got, want)
+		}
+	}
+}
+
+func TestAgentDecommission(t *testing.T) {
+	agents, peerTLSConfig, teardown := setupAgents(t, 3, nil)
+	defer teardown()
+
+	clients := clients(t, agents, peerTLSConfig)
+	require.Eventually(t, func() bool {
+		return caughtUp(agents, clients)
+	}, 10*time.Second, 100*time.Millisecond)
+
+	// keep producing while the node is decommissioned, every produce that
+	// succeeds has to be covered by the returned offset.
+	leaving := clients[2]
+	produced := make(chan uint64, 1024)
+	go func() {
+		defer close(produced)
+		for {
+			res, err := leaving.Produce(
+				context.Background(),
+				&api.ProduceRequest{
+					Record: &api.Record{
+						Value: []byte("foo"),
+					},
+				},
+			)
+			if err != nil {
+				return
+			}
+			produced <- res.Offset
+		}
+	}()
+
+	require.Eventually(t, func() bool {
+		return len(produced) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	res, err := leaving.Decommission(
+		context.Background(),
+		&api.DecommissionRequest{TimeoutMs: 10000},
+	)
+	require.NoError(t, err)
+
+	var n uint64
+	for off := range produced {
+		require.Less(t, off, res.NextOffset)
+		n++
+	}
+	require.Equal(t, n, res.NextOffset)
+
+	// the records were replicated before the node left.
+	for _, c := range clients[:2] {
+		for off := uint64(0); off < res.NextOffset; off++ {
+			consumeResponse, err := c.Consume(
+				context.Background(),
+				&api.ConsumeRequest{Offset: off},
+			)
+			require.NoError(t, err)
+			require.Equal(t, []byte("foo"), consumeResponse.Record.Value)
+		}
+	}
+
+	_, err = leaving.Produce(
+		context.Background(),
+		&api.ProduceRequest{
+			Record: &api.Record{
+				Value: []byte("bar"),
+			},
+		},
+	)
+	if got, want := status.Code(err), codes.Unavailable; got != want {
+		t.Fatalf("got code: %s, want: %s", got, want)
+	}
+
+	// the remaining nodes see the node leave and stop replicating it.
+	require.Eventually(t, func() bool {
+		replication, err := clients[0].ReplicationStatus(
+			context.Background(),
+			&api.ReplicationStatusRequest{},
+		)
+		if err != nil {
+			return false
+		}
+
+		for _, peer := range replication.Peers {
+			if peer.Name == agents[2].Config.NodeName {
+				return false
+			}
+		}
+		return true
+	}, 10*time.Second, 100*time.Millisecond)
+}
+
+func TestAgentDecommissionTimeout(t *testing.T) {
+	agents, peerTLSConfig, teardown := setupAgents(t, 2, nil)
+	defer teardown()
+
+	clients := clients(t, agents, peerTLSConfig)
+	require.Eventually(t, func() bool {
+		return caughtUp(agents, clients)
+	}, 10*time.Second, 100*time.Millisecond)
+
+	// the peer can't catch up in a millisecond.
+	_, err := clients[1].Decommission(
+		context.Background(),
+		&api.DecommissionRequest{TimeoutMs: 1},
+	)
+	require.Equal(t, codes.DeadlineExceeded, status.Code(err))
+
+	// the node stays in the cluster, taking produces and replicating.
+	_, err = clients[1].Produce(
+		context.Background(),
+		&api.ProduceRequest{
+			Record: &api.Record{
+				Value: []byte("foo"),
+			},
+		},
+	)
+	require.NoError(t, err)
+
+	_, err = clients[0].Produce(
+		context.Background(),
+		&api.ProduceRequest{
+			Record: &api.Record{
+				Value: []byte("bar"),
+			},
+		},
+	)
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return caughtUp(agents, clients)
+	}, 10*time.Second, 100*time.Millisecond)
+
+	offsets, err := clients[1].GetOffsets(context.Background(), &api.GetOffsetsRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), offsets.NextOffset)
+}
+
+func TestAgentTopologyAndGossipKeys(t *testing.T) {
+	oldKey := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 16))
+	newKey := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 16))
+
+	agents, peerTLSConfig, teardown := setupAgents(t, 3, func(c *agent.Config) {
+		c.Zone = "zone-" + c.NodeName
+		c.GossipKeys = []string{oldKey}
+		c.GossipKeyringFile = filepath.Join(c.DataDir, "keyring.json")
+	})
+	defer teardown()
+
+	c := client(t, agents[0], peerTLSConfig)
+	var topology *api.TopologyResponse
+	require.Eventually(t, func() bool {
+		var err error
+		topology, err = c.Topology(context.Background(), &api.TopologyRequest{})
+		return err == nil && len(topology.Nodes) == 3
+	}, 10*time.Second, 100*time.Millisecond)
+
+	for i, node := range topology.Nodes {
+		if node.Zone != "zone-"+node.Name {
+			t.Fatalf("got zone: %s, want: zone-%s", node.Zone, node.Name)
+		}
+
+		if node.Role != agent.DefaultRole || node.Version != agent.Version {
+			t.Fatalf("got role: %s and version: %s", node.Role, node.Version)
+		}
+
+		if node.Status != "alive" {
+			t.Fatalf("got status: %s, want: alive", node.Status)
+		}
+
+		if rpcAddr, _ := agents[i].Config.RPCAddr(); node.RpcAddr != rpcAddr {
+			t.Fatalf("got rpc addr: %s, want: %s", node.RpcAddr, rpcAddr)
+		}
+	}
+
+	if len(topology.Placements) != 3 {
+		t.Fatalf("got %d placements, want: 3", len(topology.Placements))
+	}
+
+	for _, p := range topology.Placements {
+		if p.Leader != p.Log || len(p.Replicas) != 3 || p.Zones != 3 {
+			t.Fatalf("got placement: %v", p)
+		}
+
+		if p.UnderReplicated || p.UnderReplicatedZones {
+			t.Fatalf("log %s is under-replicated", p.Log)
+		}
+	}
+
+	// rotate the gossip key.
+	ops := []*api.GossipKeysRequest{
+		{Op: api.GossipKeyOp_INSTALL_KEY, Key: newKey},
+		{Op: api.GossipKeyOp_USE_KEY, Key: newKey},
+		{Op: api.GossipKeyOp_REMOVE_KEY, Key: oldKey},
+	}
+	var (
+		keys *api.GossipKeysResponse
+		err  error
+	)
+	for _, op := range ops {
+		keys, err = c.GossipKeys(context.Background(), op)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(keys.Keys) != 1 || keys.Keys[newKey] != 3 || keys.PrimaryKeys[newKey] != 3 {
+		t.Fatalf("got keys: %v, primary keys: %v", keys.Keys, keys.PrimaryKeys)
+	}
+
+	// the rotation was persisted so restarted members keep using the key.
+	keyring, err := ioutil.ReadFile(agents[1].Config.GossipKeyringFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Contains(keyring, []byte(newKey)) || bytes.Contains(keyring, []byte(oldKey)) {
+		t.Fatalf("got keyring: %s", keyring)
+	}
+
+	// gossip still flows with the new key.
+	replication, err := c.ReplicationStatus(
+		context.Background(),
+		&api.ReplicationStatusRequest{},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, peer := range replication.Peers {
+		if peer.Zone != "zone-"+peer.Name {
+			t.Fatalf("got peer zone: %s, want: zone-%s", peer.Zone, peer.Name)
+		}
+	}
+}
+
+func TestAgentGossipKeysWithoutSerf(t *testing.T) {
+	agents, peerTLSConfig, teardown := setupAgents(t, 1, func(c *agent.Config) {
+		c.Discovery = agent.DiscoveryStatic
+	})
+	defer teardown()
+
+	_, err := client(t, agents[0], peerTLSConfig).GossipKeys(
+		context.Background(),
+		&api.GossipKeysRequest{Op: api.GossipKeyOp_LIST_KEYS},
+	)
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+func TestAgentReplicationFactor(t *testing.T) {
+	agents, peerTLSConfig, teardown := setupAgents(t, 4, func(c *agent.Config) {
+		c.ReplicationFactor = 2
+	})
+	defer teardown()
+
+	clients := clients(t, agents, peerTLSConfig)
+	require.Eventually(t, func() bool {
+		for _, c := range clients {
+			topology, err := c.Topology(context.Background(), &api.TopologyRequest{})
+			if err != nil || len(topology.Nodes) != len(agents) {
+				return false
+			}
+		}
+		return true
+	}, 10*time.Second, 100*time.Millisecond)
+
+	for i, c := range clients {
+		_, err := c.Produce(
+			context.Background(),
+			&api.ProduceRequest{
+				Record: &api.Record{
+					Value: []byte(agents[i].Config.NodeName),
+				},
+			},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	topology, err := clients[0].Topology(
+		context.Background(),
+		&api.TopologyRequest{},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := make(map[string]map[string]bool)
+	for _, agent := range agents {
+		want[agent.Config.NodeName] = make(map[string]bool)
+	}
+	for _, p := range topology.Placements {
+		if len(p.Replicas) != 2 || p.Leader != p.Log {
+			t.Fatalf("got placement: %v", p)
+		}
+
+		for _, replica := range p.Replicas {
+			want[replica][p.Log] = true
+		}
+	}
+
+	// every node ends up holding the logs placed on it, and only those.
+	var misplaced error
+	require.Eventually(t, func() bool {
+		for i, c := range clients {
+			name := agents[i].Config.NodeName
+			got := make(map[string]bool)
+			for off := uint64(0); ; off++ {
+				res, err := c.Consume(
+					context.Background(),
+					&api.ConsumeRequest{Offset: off},
+				)
+				if grpc.Code(err) == grpc.Code(api.ErrOffsetOutOfRange{}.GRPCStatus().Err()) {
+					break
+				}
+				if err != nil {
+					return false
+				}
+
+				origin := res.Record.Origin
+				if !want[name][origin] {
+					misplaced = fmt.Errorf("node %s holds %s's log", name, origin)
+					return true
+				}
+				got[origin] = true
+			}
+
+			if !reflect.DeepEqual(got, want[name]) {
+				return false
+			}
+		}
+		return true
+	}, 10*time.Second, 100*time.Millisecond)
+	require.NoError(t, misplaced)
+}
+
+func TestAgentReplicatesNamedLog(t *testing.T) {
+	agents, peerTLSConfig, teardown := setupAgents(t, 2, func(c *agent.Config) {
+		c.ReplicationFactor = 2
+	})
+	defer teardown()
+
+	clients := clients(t, agents, peerTLSConfig)
+	require.Eventually(t, func() bool {
+		return caughtUp(agents, clients)
+	}, 10*time.Second, 100*time.Millisecond)
+
+	// records are replicated under their node, whatever log they're
+	// produced to.
+	want := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		value := fmt.Sprintf("order %d", i)
+		want[value] = true
+
+		_, err := clients[0].Produce(context.Background(), &api.ProduceRequest{
+			Record: &api.Record{Value: []byte(value), Log: "orders"},
+		})
+		require.NoError(t, err)
+	}
+
+	require.Eventually(t, func() bool {
+		got := make(map[string]bool)
+		for off := uint64(0); ; off++ {
+			res, err := clients[1].Consume(context.Background(), &api.ConsumeRequest{
+				Offset: off,
+				Log:    "orders",
+			})
+			if err != nil {
+				break
+			}
+			got[string(res.Record.Value)] = true
+		}
+		return reflect.DeepEqual(want, got)
+	}, 10*time.Second, 100*time.Millisecond)
+}
+
+func TestAgentMux(t *testing.T) {
+	agents, peerTLSConfig, teardown := setupAgents(t, 1, nil)
+	defer teardown()
+
+	rpcAddr, err := agents[0].Config.RPCAddr()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// gRPC, HTTP and the segment protocol all share the RPC port.
+	c := client(t, agents[0], peerTLSConfig)
+	for i := 0; i < 64; i++ {
+		_, err := c.Produce(
+			context.Background(),
+			&api.ProduceRequest{
+				Record: &api.Record{
+					Value: bytes.Repeat([]byte{'a'}, 64),
+				},
+			},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	httpClient := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: peerTLSConfig},
+	}
+	res, err := httpClient.Get(fmt.Sprintf("https://%s/healthz", rpcAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got status: %d, want: %d", res.StatusCode, http.StatusOK)
+	}
+
+	segments, err := c.ListSegments(context.Background(), &api.ListSegmentsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info := segments.Segments[0]
+	if !info.Sealed {
+		t.Fatal("first segment isn't sealed")
+	}
+
+	segmentClient, err := server.DialSegments(rpcAddr, peerTLSConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer segmentClient.Close()
+
+	// the connection serves several requests.
+	for _, file := range []api.SegmentFile{api.SegmentFile_STORE, api.SegmentFile_INDEX} {
+		var buf bytes.Buffer
+		n, err := segmentClient.Fetch(info.BaseOffset, file, 0, 0, &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := info.StoreSize
+		if file == api.SegmentFile_INDEX {
+			want = info.IndexSize
+		}
+
+		if uint64(n) != want || uint64(buf.Len()) != want {
+			t.Fatalf("got %d bytes of %s, want: %d", n, file, want)
+		}
+	}
+
+	_, err = segmentClient.Fetch(info.BaseOffset+1000, api.SegmentFile_STORE, 0, 0, ioutil.Discard)
+	if err == nil {
+		t.Fatal("fetched a segment that doesn't exist")
+	}
+}
+
+func TestAgentSegmentOptions(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "keys")
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{'k'}, 32))
+	if err := ioutil.WriteFile(keyFile, []byte("1:"+key+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	agents, peerTLSConfig, teardown := setupAgents(t, 1, func(c *agent.Config) {
+		c.MaxStoreBytes = 1024
+		c.Compression = log.CodecGzip
+		c.EncryptionKeyFile = keyFile
+		c.IndexInterval = 256
+	})
+	defer teardown()
+
+	c := client(t, agents[0], peerTLSConfig)
+	value := bytes.Repeat([]byte{'a'}, 128)
+	for i := 0; i < 64; i++ {
+		_, err := c.Produce(
+			context.Background(),
+			&api.ProduceRequest{Record: &api.Record{Value: value}},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for off := uint64(0); off < 64; off++ {
+		res, err := c.Consume(context.Background(), &api.ConsumeRequest{Offset: off})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(res.Record.Value, value) {
+			t.Fatalf("got %q at offset %d", res.Record.Value, off)
+		}
+	}
+
+	segments, err := c.ListSegments(context.Background(), &api.ListSegmentsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the records compress well, so they only spill over into a second
+	// segment with the store size configured.
+	if len(segments.Segments) < 2 {
+		t.Fatalf("got %d segments, want several", len(segments.Segments))
+	}
+}
+
+func TestAgentMigratesLog(t *testing.T) {
+	// logs used to be kept in the data dir itself.
+	dataDir, err := ioutil.TempDir("", "agent-test-log")
+	require.NoError(t, err)
+
+	old, err := log.NewLog(dataDir, log.Config{})
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err := old.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	require.NoError(t, old.Close())
+
+	agents, peerTLSConfig, teardown := setupAgents(t, 1, func(c *agent.Config) {
+		os.RemoveAll(c.DataDir)
+		c.DataDir = dataDir
+	})
+	defer teardown()
+
+	c := client(t, agents[0], peerTLSConfig)
+	for i := 0; i < 3; i++ {
+		res, err := c.Consume(context.Background(), &api.ConsumeRequest{Offset: uint64(i)})
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("record %d", i), string(res.Record.Value))
+	}
+
+	matches, err := filepath.Glob(filepath.Join(dataDir, "*.store"))
+	require.NoError(t, err)
+	require.Empty(t, matches)
+}
+
+func TestAgentMetrics(t *testing.T) {
+	agents, peerTLSConfig, teardown := setupAgents(t, 2, nil)
+	defer teardown()
+
+	clients := clients(t, agents, peerTLSConfig)
+	require.Eventually(t, func() bool {
+		return caughtUp(agents, clients)
+	}, 10*time.Second, 100*time.Millisecond)
+
+	produceResponse, err := clients[0].Produce(
+		context.Background(),
+		&api.ProduceRequest{
+			Record: &api.Record{
+				Value: []byte("foo"),
+			},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = clients[0].Consume(context.Background(), &api.ConsumeRequest{
+		Offset: produceResponse.Offset,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rpcAddr, err := agents[1].Config.RPCAddr()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	httpClient := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: peerTLSConfig},
+	}
+	scrape := func() ([]byte, error) {
+		res, err := httpClient.Get(fmt.Sprintf("https://%s/metrics", rpcAddr))
+		if err != nil {
+			return nil, err
+		}
+		defer res.Body.Close()
+
+		if res.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("got status: %d, want: %d", res.StatusCode, http.StatusOK)
+		}
+		return ioutil.ReadAll(res.Body)
+	}
+
+	// the second agent replicated the record, reading it from the first
+	// one and appending it to its own log.
+	wants := []string{
+		"# TYPE grpc_io_server_completed_rpcs counter",
+		"# TYPE dilog_log_append_latency histogram",
+		`dilog_log_append_latency_count{log="log"}`,
+		`dilog_log_segments{log="log"} 1`,
+		`dilog_log_segments{log="audit"} 1`,
+		`dilog_log_bytes{log="log"}`,
+		`dilog_log_active_store_fill{log="log"}`,
+		`dilog_log_active_index_fill{log="log"}`,
+		`dilog_replicator_lag{peer=`,
+		`dilog_membership_members{status="alive"} 2`,
+	}
+
+	require.Eventually(t, func() bool {
+		b, err := scrape()
+		if err != nil {
+			return false
+		}
+
+		for _, want := range wants {
+			if !bytes.Contains(b, []byte(want)) {
+				return false
+			}
+		}
+		return true
+	}, 10*time.Second, 100*time.Millisecond, "metrics don't contain %q", wants)
+}
+
+// collector is an OpenTelemetry collector stand-in that keeps the spans
+// posted to it.
+type collector struct {
+	mu    sync.Mutex
+	spans []collectedSpan
+}
+
+type collectedSpan struct {
+	TraceID      string
+	SpanID       string
+	ParentSpanID string
+	Name         string
+	Links        []struct {
+		TraceID string
+		SpanID  string
+	}
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	req := &coltracepb.ExportTraceServiceRequest{}
+	if err := proto.Unmarshal(b, req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, rs := range req.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			for _, span := range ss.Spans {
+				collected := collectedSpan{
+					TraceID: hex.EncodeToString(span.TraceId),
+					SpanID:  hex.EncodeToString(span.SpanId),
+					Name:    span.Name,
+				}
+				if len(span.ParentSpanId) != 0 {
+					collected.ParentSpanID = hex.EncodeToString(span.ParentSpanId)
+				}
+				for _, link := range span.Links {
+					collected.Links = append(collected.Links, struct {
+						TraceID string
+						SpanID  string
+					}{hex.EncodeToString(link.TraceId), hex.EncodeToString(link.SpanId)})
+				}
+				c.spans = append(c.spans, collected)
+			}
+		}
+	}
+}
+
+// replicationTrace returns the span of the second agent replicating the
+// record produced in the first one's Produce span, along with the second
+// agent's Produce span, which should be its child.
+func (c *collector) replicationTrace() (produce, apply, replicated *collectedSpan) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i := range c.spans {
+		span := &c.spans[i]
+		if span.Name == "log.v1.Log.Produce" && span.ParentSpanID == "" {
+			produce = span
+		}
+	}
+	if produce == nil {
+		return nil, nil, nil
+	}
+
+	for i := range c.spans {
+		span := &c.spans[i]
+		for _, link := range span.Links {
+			if span.Name == "log.Replicator.apply" && link.SpanID == produce.SpanID {
+				apply = span
+			}
+		}
+	}
+	if apply == nil {
+		return produce, nil, nil
+	}
+
+	for i := range c.spans {
+		span := &c.spans[i]
+		if span.Name == "log.v1.Log.Produce" && span.TraceID == apply.TraceID && span.ParentSpanID != "" {
+			replicated = span
+		}
+	}
+
+	return produce, apply, replicated
+}
+
+func TestAgentTracing(t *testing.T) {
+	c := &collector{}
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+
+	agents, peerTLSConfig, teardown := setupAgents(t, 2, func(config *agent.Config) {
+		config.TraceSampleRate = -1
+		config.OTLPEndpoint = srv.URL
+	})
+
+	clients := clients(t, agents, peerTLSConfig)
+	require.Eventually(t, func() bool {
+		return caughtUp(agents, clients)
+	}, 10*time.Second, 100*time.Millisecond)
+
+	_, err := clients[0].Produce(
+		context.Background(),
+		&api.ProduceRequest{
+			Record: &api.Record{
+				Value: []byte("foo"),
+			},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	require.Eventually(t, func() bool {
+		return caughtUp(agents, clients)
+	}, 10*time.Second, 100*time.Millisecond)
+
+	// shutting the agents down sends the spans they haven't yet.
+	teardown()
+
+	produce, apply, replicated := c.replicationTrace()
+	if produce == nil {
+		t.Fatal("produce wasn't traced")
+	}
+	if apply == nil {
+		t.Fatal("replicating the record wasn't traced or isn't linked to its produce")
+	}
+	if replicated == nil {
+		t.Fatal("the replicated produce isn't part of the replication's trace")
+	}
+	if apply.TraceID == produce.TraceID {
+		t.Fatal("replication is part of the produce's trace instead of linked to it")
+	}
+}
+
+func TestAgentReloadACL(t *testing.T) {
+	agents, peerTLSConfig, teardown := setupAgents(t, 1, func(c *agent.Config) {
+		for _, file := range []string{config.ACLModelFile, config.ACLPolicyFile} {
+			b, err := ioutil.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			name := filepath.Join(c.DataDir, filepath.Base(file))
+			if err := ioutil.WriteFile(name, b, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		c.ACLModelFile = filepath.Join(c.DataDir, filepath.Base(config.ACLModelFile))
+		c.ACLPolicyFile = filepath.Join(c.DataDir, filepath.Base(config.ACLPolicyFile))
+	})
+	defer teardown()
+
+	c := client(t, agents[0], peerTLSConfig)
+	produce := func() error {
+		_, err := c.Produce(
+			context.Background(),
+			&api.ProduceRequest{
+				Record: &api.Record{
+					Value: []byte("foo"),
+				},
+			},
+		)
+		return err
+	}
+
+	res, err := c.ReloadACL(context.Background(), &api.ReloadACLRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Rules != 6 {
+		t.Fatalf("got %d rules, want: 6", res.Rules)
+	}
+
+	// reloads made by the watcher are audited.
+	audited := func(result codes.Code) bool {
+		res, err := c.QueryAudit(context.Background(), &api.QueryAuditRequest{
+			Subject: "file watcher",
+			Object:  "acl",
+		})
+		if err != nil {
+			return false
+		}
+
+		for _, entry := range res.Entries {
+			if entry.Result == result.String() {
+				return true
+			}
+		}
+		return false
+	}
+
+	// an invalid policy is rejected and the previous one stays.
+	policy := agents[0].Config.ACLPolicyFile
+	if err := ioutil.WriteFile(policy, []byte("p, root\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = c.ReloadACL(context.Background(), &api.ReloadACLRequest{})
+	if got, want := status.Code(err), codes.InvalidArgument; got != want {
+		t.Fatalf("got code: %s, want: %s", got, want)
+	}
+
+	require.Eventually(t, func() bool {
+		return audited(codes.InvalidArgument)
+	}, 5*time.Second, 50*time.Millisecond)
+
+	if err := produce(); err != nil {
+		t.Fatal(err)
+	}
+
+	// changes to the file are picked up without calling the RPC.
+	revoked := []byte("p, root, *, consume\np, root, *, admin\n")
+	if err := ioutil.WriteFile(policy, revoked, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	require.Eventually(t, func() bool {
+		return status.Code(produce()) == codes.PermissionDenied
+	}, 5*time.Second, 50*time.Millisecond)
+	require.Eventually(t, func() bool {
+		return audited(codes.OK)
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+// writeCerts writes a new CA and a server and root client certificate signed
+// by it to dir.
+func writeCerts(t *testing.T, dir string) {
+	t.Helper()
+
+	newKey := func() *ecdsa.PrivateKey {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+
+	write := func(name, typ string, b []byte) {
+		f, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		if err := pem.Encode(f, &pem.Block{Type: typ, Bytes: b}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	caKey := newKey()
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "Dilog Test CA"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, caKey.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write("ca.pem", "CERTIFICATE", caDER)
+
+	for name, template := range map[string]*x509.Certificate{
+		"server": {
+			Subject:     pkix.Name{CommonName: "127.0.0.1"},
+			IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		},
+		"client": {
+			Subject:     pkix.Name{CommonName: "root"},
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		},
+	} {
+		template.SerialNumber = big.NewInt(time.Now().UnixNano())
+		template.NotBefore = time.Now().Add(-time.Minute)
+		template.NotAfter = time.Now().Add(time.Hour)
+		template.KeyUsage = x509.KeyUsageDigitalSignature
+
+		key := newKey()
+		der, err := x509.CreateCertificate(rand.Reader, template, ca, key.Public(), caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		write(name+".pem", "CERTIFICATE", der)
+		write(name+"-key.pem", "EC PRIVATE KEY", keyDER)
+	}
+}
+
+func TestAgentCertificateRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agent-test-certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeCerts(t, dir)
+
+	files := func(name string, server bool) *config.TLSConfig {
+		return &config.TLSConfig{
+			CertFile:      filepath.Join(dir, name+".pem"),
+			KeyFile:       filepath.Join(dir, name+"-key.pem"),
+			CAFile:        filepath.Join(dir, "ca.pem"),
+			Server:        server,
+			ServerAddress: "127.0.0.1",
+		}
+	}
+
+	// the agent loads the files itself and keeps watching them.
+	agents, _, teardown := setupAgents(t, 1, func(c *agent.Config) {
+		c.ServerTLSConfig = nil
+		c.PeerTLSConfig = nil
+		c.ServerTLSFiles = files("server", true)
+		c.PeerTLSFiles = files("client", false)
+	})
+	defer teardown()
+	peerTLSConfig := agents[0].Config.PeerTLSConfig
+
+	produce := func(tlsConfig *tls.Config) error {
+		_, err := client(t, agents[0], tlsConfig).Produce(
+			context.Background(),
+			&api.ProduceRequest{Record: &api.Record{Value: []byte("foo")}},
+		)
+		return err
+	}
+
+	if err := produce(peerTLSConfig); err != nil {
+		t.Fatal(err)
+	}
+
+	// rotate to a new CA, renaming the files into place like certificate
+	// managers do.
+	rotated, err := ioutil.TempDir(dir, "rotated")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeCerts(t, rotated)
+
+	for _, name := range []string{"ca.pem", "server.pem", "server-key.pem", "client.pem", "client-key.pem"} {
+		if err := os.Rename(filepath.Join(rotated, name), filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a client that only trusts the new CA gets in once the server picked up
+	// the new certificate and CA.
+	newOnly, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      filepath.Join(dir, "client.pem"),
+		KeyFile:       filepath.Join(dir, "client-key.pem"),
+		CAFile:        filepath.Join(dir, "ca.pem"),
+		ServerAddress: "127.0.0.1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	require.Eventually(t, func() bool {
+		return produce(newOnly) == nil
+	}, 5*time.Second, 100*time.Millisecond, "server didn't pick up the new certificates")
+
+	// the peer credentials are reloaded by a watcher of their own.
+	require.Eventually(t, func() bool {
+		return produce(peerTLSConfig) == nil
+	}, 5*time.Second, 100*time.Millisecond, "peer credentials didn't pick up the new certificates")
 }
@@ -0,0 +1,193 @@
+package agent
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/nireo/dilog/internal/discovery"
+	"github.com/nireo/dilog/internal/placement"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	api "github.com/nireo/dilog/api/v1"
+)
+
+// Version is advertised to the other members, it's set at build time with
+// -ldflags "-X github.com/nireo/dilog/internal/agent.Version=...".
+var Version = "dev"
+
+// DefaultRole is advertised by agents that aren't configured with a role.
+const DefaultRole = "server"
+
+// errGossipNotSerf is returned for gossip key operations on agents whose
+// members aren't found by gossiping.
+var errGossipNotSerf = status.Error(
+	codes.FailedPrecondition,
+	"gossip keys need the serf discovery backend",
+)
+
+// tags returns the tags the agent advertises to the other members.
+func (a *Agent) tags() (map[string]string, error) {
+	rpcAddr, err := a.Config.RPCAddr()
+	if err != nil {
+		return nil, err
+	}
+
+	role := a.Config.Role
+	if role == "" {
+		role = DefaultRole
+	}
+
+	tags := map[string]string{
+		discovery.TagRPCAddr: rpcAddr,
+		discovery.TagRole:    role,
+		discovery.TagVersion: Version,
+	}
+
+	// HTTP is served on the RPC port unless it's behind another address.
+	httpAddr := a.Config.HTTPAddr
+	if httpAddr == "" {
+		httpAddr = rpcAddr
+	}
+
+	optional := map[string]string{
+		discovery.TagHTTPAddr: httpAddr,
+		discovery.TagZone:     a.Config.Zone,
+		discovery.TagRack:     a.Config.Rack,
+	}
+	for tag, value := range optional {
+		if value != "" {
+			tags[tag] = value
+		}
+	}
+
+	return tags, nil
+}
+
+// Topology returns every member of the cluster the agent knows of, sorted by
+// name.
+func (a *Agent) Topology() []*api.Node {
+	members := a.membership.Members()
+	nodes := make([]*api.Node, 0, len(members))
+	for _, member := range members {
+		nodes = append(nodes, &api.Node{
+			Name:     member.Name,
+			RpcAddr:  member.RPCAddr(),
+			HttpAddr: member.HTTPAddr(),
+			Role:     member.Role(),
+			Version:  member.Version(),
+			Zone:     member.Zone(),
+			Rack:     member.Rack(),
+			Status:   member.Status.String(),
+		})
+	}
+
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Name < nodes[j].Name
+	})
+
+	return nodes
+}
+
+// placementNodes returns the members that can hold replicas. Members that
+// left the cluster on purpose were drained first, so they're ignored.
+func (a *Agent) placementNodes() []placement.Node {
+	var nodes []placement.Node
+	for _, member := range a.membership.Members() {
+		if member.Status == discovery.StatusLeft {
+			continue
+		}
+
+		nodes = append(nodes, placement.Node{
+			Name:  member.Name,
+			Zone:  member.Zone(),
+			Alive: member.Status == discovery.StatusAlive,
+		})
+	}
+
+	return nodes
+}
+
+// replicationFactor returns the number of nodes each log is kept on. Without
+// one configured, every node keeps every log.
+func (a *Agent) replicationFactor(nodes []placement.Node) int {
+	if a.Config.ReplicationFactor > 0 {
+		return a.Config.ReplicationFactor
+	}
+	return len(nodes)
+}
+
+// Placements returns where each member's log is replicated.
+func (a *Agent) Placements() []*api.Placement {
+	nodes := a.placementNodes()
+
+	var res []*api.Placement
+	for _, p := range placement.PlaceAll(nodes, a.replicationFactor(nodes)) {
+		var leader string
+		if n, ok := p.Leader(); ok {
+			leader = n.Name
+		}
+
+		replicas := make([]string, 0, len(p.Replicas))
+		for _, n := range p.Replicas {
+			replicas = append(replicas, n.Name)
+		}
+
+		res = append(res, &api.Placement{
+			Log:                  p.Log,
+			Leader:               leader,
+			Replicas:             replicas,
+			ReplicationFactor:    uint32(p.Factor),
+			Zones:                uint32(p.Zones),
+			WantZones:            uint32(p.WantZones),
+			UnderReplicated:      p.UnderReplicated(),
+			UnderReplicatedZones: p.UnderReplicatedZones(),
+		})
+	}
+
+	return res
+}
+
+// GossipKeys runs a keyring operation across the cluster and returns the
+// resulting keyring.
+func (a *Agent) GossipKeys(op api.GossipKeyOp, key string) (*api.GossipKeysResponse, error) {
+	s, ok := a.membership.(*discovery.Serf)
+	if !ok {
+		return nil, errGossipNotSerf
+	}
+
+	var err error
+	switch op {
+	case api.GossipKeyOp_LIST_KEYS:
+	case api.GossipKeyOp_INSTALL_KEY:
+		err = s.InstallKey(key)
+	case api.GossipKeyOp_USE_KEY:
+		err = s.UseKey(key)
+	case api.GossipKeyOp_REMOVE_KEY:
+		err = s.RemoveKey(key)
+	default:
+		err = fmt.Errorf("unknown gossip key operation: %v", op)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := s.ListKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	return &api.GossipKeysResponse{
+		Keys:        counts(keys.Keys),
+		PrimaryKeys: counts(keys.PrimaryKeys),
+		NumNodes:    int32(keys.NumNodes),
+	}, nil
+}
+
+func counts(m map[string]int) map[string]int32 {
+	res := make(map[string]int32, len(m))
+	for k, v := range m {
+		res[k] = int32(v)
+	}
+	return res
+}
@@ -0,0 +1,145 @@
+package agent
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/nireo/dilog/internal/log"
+	"github.com/nireo/dilog/internal/placement"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+
+	api "github.com/nireo/dilog/api/v1"
+)
+
+// catchUpPollInterval is how often peers are asked how far they've
+// replicated while decommissioning.
+const catchUpPollInterval = 250 * time.Millisecond
+
+// Decommission drains the agent so it can be removed from the cluster: it
+// stops taking produces and replicating from peers, waits for every live
+// peer holding a replica of its log to replicate it and then leaves the
+// cluster. It returns the log's next offset at the time produces stopped.
+// If the peers don't catch up in time, the agent goes back to taking
+// produces and replicating.
+func (a *Agent) Decommission(ctx context.Context) (uint64, error) {
+	// the node is leaving, so there's no point in replicating records it'd
+	// then have to wait on its peers to copy back.
+	a.replicator.Pause()
+
+	// produces that got past the check before the flag was set have been
+	// appended once the lock is held, so next covers every record.
+	a.produceMu.Lock()
+	atomic.StoreInt32(&a.decommissioning, 1)
+	next, err := a.log.NextOffset()
+	a.produceMu.Unlock()
+
+	if err == nil {
+		err = a.waitForPeers(ctx, next)
+	}
+	if err == nil {
+		zap.L().Named("agent").Info(
+			"peers caught up, leaving cluster",
+			zap.String("name", a.Config.NodeName),
+			zap.Uint64("next_offset", next),
+		)
+		err = a.membership.Leave()
+	}
+
+	if err != nil {
+		atomic.StoreInt32(&a.decommissioning, 0)
+		a.replicator.Resume()
+		return 0, err
+	}
+
+	return next, nil
+}
+
+func (a *Agent) Decommissioning() bool {
+	return atomic.LoadInt32(&a.decommissioning) == 1
+}
+
+// produceLog is the log the server appends to. Appends check whether the
+// agent is decommissioning with produceMu held, so that decommissioning can
+// wait for the produces in flight.
+type produceLog struct {
+	*log.Log
+	agent *Agent
+}
+
+func (l produceLog) Append(record *api.Record) (uint64, error) {
+	l.agent.produceMu.RLock()
+	defer l.agent.produceMu.RUnlock()
+
+	if l.agent.Decommissioning() {
+		return 0, status.Error(codes.Unavailable, "node is being decommissioned")
+	}
+
+	return l.Log.Append(record)
+}
+
+// waitForPeers blocks until every live peer holding a replica of the local
+// log has replicated it up to next, or ctx is done.
+func (a *Agent) waitForPeers(ctx context.Context, next uint64) error {
+	nodes := a.placementNodes()
+	replicas := placement.Place(a.Config.NodeName, nodes, a.replicationFactor(nodes))
+
+	var opts []grpc.DialOption
+	if a.Config.PeerTLSConfig != nil {
+		opts = append(opts, grpc.WithTransportCredentials(
+			credentials.NewTLS(a.Config.PeerTLSConfig),
+		))
+	}
+
+	pending := make(map[string]api.LogClient)
+	for _, member := range a.membership.Members() {
+		if member.Name == a.Config.NodeName || !replicas.Has(member.Name) {
+			continue
+		}
+
+		conn, err := grpc.Dial(member.RPCAddr(), opts...)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		pending[member.Name] = api.NewLogClient(conn)
+	}
+
+	ticker := time.NewTicker(catchUpPollInterval)
+	defer ticker.Stop()
+
+	for len(pending) > 0 {
+		for name, client := range pending {
+			res, err := client.ReplicationStatus(ctx, &api.ReplicationStatusRequest{})
+			if err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				continue
+			}
+
+			for _, peer := range res.Peers {
+				if peer.Name == a.Config.NodeName && peer.ReplicatedOffset >= next {
+					delete(pending, name)
+				}
+			}
+		}
+
+		if len(pending) == 0 {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	return nil
+}
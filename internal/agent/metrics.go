@@ -0,0 +1,110 @@
+package agent
+
+import (
+	ocprom "contrib.go.opencensus.io/exporter/prometheus"
+	"github.com/nireo/dilog/internal/discovery"
+	"github.com/nireo/dilog/internal/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// statsLog is a log whose size is exported, the audit log wraps a log.Log.
+type statsLog interface {
+	Name() string
+	Stats() log.Stats
+}
+
+// setupMetrics serves the registered views on /metrics for Prometheus to
+// scrape, along with gauges of the logs' sizes and of the cluster's members.
+// The gauges are kept in the agent's own registry rather than the global
+// one, so that each agent only serves its own. The membership is only read
+// when the metrics are, which is once the agent is serving.
+func (a *Agent) setupMetrics() error {
+	registry := prometheus.NewRegistry()
+
+	logs := []statsLog{a.log, a.audit}
+	gauges := []struct {
+		name  string
+		help  string
+		value func(log.Stats) float64
+	}{
+		{
+			name:  "dilog_log_segments",
+			help:  "Number of segments by log",
+			value: func(s log.Stats) float64 { return float64(s.Segments) },
+		},
+		{
+			name:  "dilog_log_bytes",
+			help:  "Size of the segments on disk by log",
+			value: func(s log.Stats) float64 { return float64(s.Bytes) },
+		},
+		{
+			name:  "dilog_log_active_store_fill",
+			help:  "Fraction of the active segment's store in use by log",
+			value: func(s log.Stats) float64 { return s.StoreFill },
+		},
+		{
+			name:  "dilog_log_active_index_fill",
+			help:  "Fraction of the active segment's index in use by log",
+			value: func(s log.Stats) float64 { return s.IndexFill },
+		},
+	}
+
+	for _, g := range gauges {
+		for _, l := range logs {
+			l, value := l, g.value
+			gauge := prometheus.NewGaugeFunc(
+				prometheus.GaugeOpts{
+					Name:        g.name,
+					Help:        g.help,
+					ConstLabels: prometheus.Labels{"log": l.Name()},
+				},
+				func() float64 { return value(l.Stats()) },
+			)
+			if err := registry.Register(gauge); err != nil {
+				return err
+			}
+		}
+	}
+
+	statuses := []discovery.MemberStatus{
+		discovery.StatusAlive,
+		discovery.StatusLeaving,
+		discovery.StatusLeft,
+		discovery.StatusFailed,
+	}
+	for _, status := range statuses {
+		status := status
+		gauge := prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Name:        "dilog_membership_members",
+				Help:        "Number of cluster members, including this node, by status",
+				ConstLabels: prometheus.Labels{"status": status.String()},
+			},
+			func() float64 { return float64(a.countMembers(status)) },
+		)
+		if err := registry.Register(gauge); err != nil {
+			return err
+		}
+	}
+
+	logger := zap.L().Named("metrics")
+	var err error
+	a.metrics, err = ocprom.NewExporter(ocprom.Options{
+		Registry: registry,
+		OnError: func(err error) {
+			logger.Error("failed to export metrics", zap.Error(err))
+		},
+	})
+	return err
+}
+
+func (a *Agent) countMembers(status discovery.MemberStatus) int64 {
+	var n int64
+	for _, m := range a.membership.Members() {
+		if m.Status == status {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,56 @@
+package agent
+
+import (
+	"github.com/nireo/dilog/internal/tracing"
+	"go.opencensus.io/trace"
+	"go.uber.org/zap"
+)
+
+// setupTracing configures which calls are traced and, with an OTLP
+// endpoint, where their spans are sent. Both are global to the process.
+func (a *Agent) setupTracing() error {
+	rate := a.Config.TraceSampleRate
+	if rate == 0 {
+		rate = tracing.DefaultSampleRate
+	}
+
+	always := a.Config.TraceAlwaysSample
+	if always == nil {
+		always = tracing.DefaultAlwaysSampled
+	}
+
+	trace.ApplyConfig(trace.Config{DefaultSampler: tracing.Sampler(rate, always)})
+
+	if a.Config.OTLPEndpoint == "" {
+		return nil
+	}
+
+	logger := zap.L().Named("tracing")
+	exporter, err := tracing.NewOTLPExporter(tracing.OTLPConfig{
+		Endpoint:        a.Config.OTLPEndpoint,
+		Headers:         a.Config.OTLPHeaders,
+		ServiceName:     "dilog",
+		ServiceInstance: a.Config.NodeName,
+		OnError: func(err error) {
+			logger.Error("failed to export spans", zap.Error(err))
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	a.exporter = exporter
+	trace.RegisterExporter(exporter)
+
+	return nil
+}
+
+// closeTracing sends the spans that haven't been yet.
+func (a *Agent) closeTracing() error {
+	if a.exporter == nil {
+		return nil
+	}
+
+	trace.UnregisterExporter(a.exporter)
+	return a.exporter.Close()
+}
@@ -0,0 +1,258 @@
+// Package audit keeps a record of who did what to the log, in a log of its
+// own.
+package audit
+
+import (
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nireo/dilog/internal/log"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+
+	api "github.com/nireo/dilog/api/v1"
+)
+
+const (
+	// DefaultQueryLimit is the number of entries a query returns unless it
+	// asks for fewer.
+	DefaultQueryLimit = 100
+	// MaxQueryLimit bounds the number of entries a single query returns.
+	MaxQueryLimit = 1000
+
+	// DefaultMaxStoreBytes and DefaultMaxIndexBytes bound the audit log's
+	// segments unless Config sets other sizes. An index this size holds
+	// about as many entries as the store.
+	DefaultMaxStoreBytes = 16 << 20
+	DefaultMaxIndexBytes = 1 << 20
+
+	// retentionInterval is how often segments past the retention limits
+	// are looked for, besides when the audit log is opened.
+	retentionInterval = time.Minute
+)
+
+// Config sets the size of the audit log's segments and how long they're
+// kept.
+type Config struct {
+	// MaxStoreBytes and MaxIndexBytes bound each segment's files, they
+	// default to DefaultMaxStoreBytes and DefaultMaxIndexBytes.
+	MaxStoreBytes uint64
+	MaxIndexBytes uint64
+	// MaxBytes removes the oldest segments once the audit log takes more
+	// space than it, and MaxAge the segments whose newest entry is older
+	// than it. Zero keeps them. The segment being written to is always
+	// kept.
+	MaxBytes uint64
+	MaxAge   time.Duration
+}
+
+// Log stores audit entries as the records of a log.Log.
+type Log struct {
+	log    *log.Log
+	config Config
+
+	done   chan struct{}
+	closed chan struct{}
+}
+
+// New opens the audit log in dir, creating it if needed, and removes its
+// old entries in the background if it has retention limits.
+func New(dir string, c Config) (*Log, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	if c.MaxStoreBytes == 0 {
+		c.MaxStoreBytes = DefaultMaxStoreBytes
+	}
+	if c.MaxIndexBytes == 0 {
+		c.MaxIndexBytes = DefaultMaxIndexBytes
+	}
+
+	logConfig := log.Config{}
+	logConfig.Segment.MaxStoreBytes = c.MaxStoreBytes
+	logConfig.Segment.MaxIndexBytes = c.MaxIndexBytes
+	l, err := log.NewLog(dir, logConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &Log{
+		log:    l,
+		config: c,
+		done:   make(chan struct{}),
+		closed: make(chan struct{}),
+	}
+
+	if err := a.retain(time.Now()); err != nil {
+		l.Close()
+		return nil, err
+	}
+	go a.retainEvery(retentionInterval)
+
+	return a, nil
+}
+
+// Record appends the entry to the audit log.
+func (l *Log) Record(entry *api.AuditEntry) error {
+	b, err := proto.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	_, err = l.log.Append(&api.Record{Value: b})
+	return err
+}
+
+// Query returns the entries matching the request's filters, scanning from
+// the request's offset until it has found its limit of them or reached the
+// end of the audit log.
+func (l *Log) Query(req *api.QueryAuditRequest) (*api.QueryAuditResponse, error) {
+	limit := int(req.Limit)
+	if limit == 0 {
+		limit = DefaultQueryLimit
+	}
+	if limit > MaxQueryLimit {
+		limit = MaxQueryLimit
+	}
+
+	off := req.Offset
+	if lowest, err := l.log.LowestOffset(); err != nil {
+		return nil, err
+	} else if off < lowest {
+		off = lowest
+	}
+
+	next, err := l.log.NextOffset()
+	if err != nil {
+		return nil, err
+	}
+
+	res := &api.QueryAuditResponse{}
+	for ; off < next && len(res.Entries) < limit; off++ {
+		entry, err := l.entry(off)
+		if err != nil {
+			return nil, err
+		}
+
+		if matches(req, entry) {
+			res.Entries = append(res.Entries, entry)
+		}
+	}
+	res.NextOffset = off
+
+	return res, nil
+}
+
+func matches(req *api.QueryAuditRequest, entry *api.AuditEntry) bool {
+	switch {
+	case req.Subject != "" && entry.Subject != req.Subject:
+		return false
+	case req.Action != "" && entry.Action != req.Action:
+		return false
+	case req.Object != "" && !strings.HasPrefix(entry.Object, req.Object):
+		return false
+	case req.Result != "" && entry.Result != req.Result:
+		return false
+	case req.Since != 0 && entry.Time < req.Since:
+		return false
+	case req.Until != 0 && entry.Time > req.Until:
+		return false
+	}
+	return true
+}
+
+// Name and Stats describe the underlying log, for metrics.
+func (l *Log) Name() string {
+	return l.log.Name()
+}
+
+func (l *Log) Stats() log.Stats {
+	return l.log.Stats()
+}
+
+// retainEvery removes the segments past the retention limits every
+// interval, until the audit log is closed.
+func (l *Log) retainEvery(interval time.Duration) {
+	defer close(l.closed)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.done:
+			return
+		case now := <-ticker.C:
+			if err := l.retain(now); err != nil {
+				zap.L().Named("audit").Error("failed to remove old audit entries", zap.Error(err))
+			}
+		}
+	}
+}
+
+// retain removes the oldest sealed segments for as long as the audit log is
+// over MaxBytes or their newest entry is older than MaxAge at now.
+func (l *Log) retain(now time.Time) error {
+	if l.config.MaxBytes == 0 && l.config.MaxAge == 0 {
+		return nil
+	}
+
+	segments := l.log.Segments()
+	var size uint64
+	for _, s := range segments {
+		size += s.StoreSize + s.IndexSize
+	}
+
+	// the log's Truncate removes every segment whose records are all at or
+	// below the offset it's given, which takes an empty active segment along
+	// with the segment before it. So the segment with the newest entry is
+	// kept until another entry is written.
+	next := segments[len(segments)-1].NextOffset
+
+	var lowest uint64
+	for _, s := range segments {
+		if !s.Sealed || s.NextOffset == s.BaseOffset || s.NextOffset >= next {
+			break
+		}
+
+		expired := false
+		if l.config.MaxAge != 0 {
+			newest, err := l.entry(s.NextOffset - 1)
+			if err != nil {
+				return err
+			}
+			expired = now.Sub(time.Unix(0, newest.Time)) > l.config.MaxAge
+		}
+
+		if !expired && (l.config.MaxBytes == 0 || size <= l.config.MaxBytes) {
+			break
+		}
+
+		size -= s.StoreSize + s.IndexSize
+		lowest = s.NextOffset
+	}
+
+	if lowest == 0 {
+		return nil
+	}
+
+	return l.log.Truncate(lowest - 1)
+}
+
+func (l *Log) entry(off uint64) (*api.AuditEntry, error) {
+	record, err := l.log.Read(off)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &api.AuditEntry{}
+	return entry, proto.Unmarshal(record.Value, entry)
+}
+
+func (l *Log) Close() error {
+	close(l.done)
+	<-l.closed
+	return l.log.Close()
+}
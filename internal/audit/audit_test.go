@@ -0,0 +1,70 @@
+package audit
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/nireo/dilog/api/v1"
+)
+
+func TestRetention(t *testing.T) {
+	now := time.Now()
+
+	for scenario, fn := range map[string]func(t *testing.T, l *Log){
+		"entries older than max age are removed": func(t *testing.T, l *Log) {
+			l.config.MaxAge = time.Hour
+		},
+		"oldest entries past max bytes are removed": func(t *testing.T, l *Log) {
+			segments := l.log.Segments()
+			var size uint64
+			for _, s := range segments[2:] {
+				size += s.StoreSize + s.IndexSize
+			}
+			l.config.MaxBytes = size
+		},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "audit-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			// every entry fills a segment of its own.
+			l, err := New(dir, Config{MaxStoreBytes: 1})
+			require.NoError(t, err)
+			defer l.Close()
+
+			for _, age := range []time.Duration{3 * time.Hour, 2 * time.Hour, 0} {
+				require.NoError(t, l.Record(&api.AuditEntry{
+					Time:    now.Add(-age).UnixNano(),
+					Subject: "root",
+				}))
+			}
+
+			fn(t, l)
+			require.NoError(t, l.retain(now))
+
+			res, err := l.Query(&api.QueryAuditRequest{})
+			require.NoError(t, err)
+			require.Len(t, res.Entries, 1)
+			require.Equal(t, now.UnixNano(), res.Entries[0].Time)
+
+			// the segment being written to and the newest entry are kept
+			// whatever the limits.
+			l.config.MaxAge = time.Nanosecond
+			l.config.MaxBytes = 1
+			require.NoError(t, l.retain(now.Add(time.Hour)))
+			require.Len(t, l.log.Segments(), 2)
+
+			require.NoError(t, l.Record(&api.AuditEntry{Time: now.Add(time.Minute).UnixNano()}))
+			require.NoError(t, l.retain(now.Add(time.Hour)))
+			res, err = l.Query(&api.QueryAuditRequest{})
+			require.NoError(t, err)
+			require.Len(t, res.Entries, 1)
+			require.Equal(t, now.Add(time.Minute).UnixNano(), res.Entries[0].Time)
+		})
+	}
+}
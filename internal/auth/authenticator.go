@@ -0,0 +1,263 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+const (
+	// AuthorizationHeader carries bearer tokens as "Bearer <token>".
+	AuthorizationHeader = "authorization"
+	// APIKeyHeader carries API keys.
+	APIKeyHeader = "x-api-key"
+
+	bearerPrefix = "bearer "
+)
+
+// Identities a client certificate can authenticate as.
+const (
+	// IdentityCommonName is the certificate's subject common name.
+	IdentityCommonName = "cn"
+	// IdentityDNSName is the certificate's first DNS subject alternative
+	// name.
+	IdentityDNSName = "dns"
+	// IdentitySPIFFE is the certificate's SPIFFE ID, its spiffe:// URI
+	// subject alternative name.
+	IdentitySPIFFE = "spiffe"
+)
+
+// MTLS authenticates clients by their verified certificate.
+type MTLS struct {
+	// Identity selects which of the certificate's names is the subject,
+	// defaults to IdentityCommonName.
+	Identity string
+	// TrustDomain restricts SPIFFE IDs to the trust domain if set.
+	TrustDomain string
+}
+
+// Authenticate returns the client certificate's identity. ok is false if the
+// connection isn't TLS, and a connection without a verified certificate is an
+// error.
+func (m MTLS) Authenticate(ctx context.Context) (subject string, ok bool, err error) {
+	p, found := peer.FromContext(ctx)
+	if !found || p.AuthInfo == nil {
+		return "", false, nil
+	}
+
+	tlsInfo, found := p.AuthInfo.(credentials.TLSInfo)
+	if !found {
+		return "", false, nil
+	}
+
+	subject, err = m.AuthenticateTLS(tlsInfo.State)
+	if err != nil {
+		return "", false, err
+	}
+
+	return subject, true, nil
+}
+
+// AuthenticateTLS returns the identity of the connection's verified client
+// certificate.
+func (m MTLS) AuthenticateTLS(state tls.ConnectionState) (string, error) {
+	chains := state.VerifiedChains
+	if len(chains) == 0 || len(chains[0]) == 0 {
+		return "", status.Error(codes.Unauthenticated, "client certificate wasn't verified")
+	}
+	cert := chains[0][0]
+
+	switch m.Identity {
+	case IdentityCommonName, "":
+		if cert.Subject.CommonName == "" {
+			return "", status.Error(codes.Unauthenticated, "client certificate has no common name")
+		}
+		return cert.Subject.CommonName, nil
+	case IdentityDNSName:
+		if len(cert.DNSNames) == 0 {
+			return "", status.Error(codes.Unauthenticated, "client certificate has no dns name")
+		}
+		return cert.DNSNames[0], nil
+	case IdentitySPIFFE:
+		return m.spiffeID(cert)
+	default:
+		msg := fmt.Sprintf("unknown certificate identity: %q", m.Identity)
+		return "", status.Error(codes.Internal, msg)
+	}
+}
+
+// spiffeID returns the certificate's SPIFFE ID. The SPIFFE spec allows
+// exactly one URI name in SVIDs.
+func (m MTLS) spiffeID(cert *x509.Certificate) (string, error) {
+	if len(cert.URIs) != 1 || cert.URIs[0].Scheme != "spiffe" {
+		return "", status.Error(codes.Unauthenticated, "client certificate has no spiffe id")
+	}
+
+	id := cert.URIs[0]
+	if id.Host == "" || id.User != nil || id.RawQuery != "" || id.Fragment != "" {
+		msg := fmt.Sprintf("invalid spiffe id: %q", id)
+		return "", status.Error(codes.Unauthenticated, msg)
+	}
+
+	if m.TrustDomain != "" && !strings.EqualFold(id.Host, m.TrustDomain) {
+		msg := fmt.Sprintf("spiffe id %q isn't in trust domain %q", id, m.TrustDomain)
+		return "", status.Error(codes.Unauthenticated, msg)
+	}
+
+	return id.String(), nil
+}
+
+// APIKeys authenticates clients by static API keys sent in the x-api-key
+// header.
+type APIKeys struct {
+	// subjects is keyed by the keys' hashes so the keys themselves aren't
+	// compared byte by byte.
+	subjects map[[sha256.Size]byte]string
+}
+
+// NewAPIKeys returns an authenticator for keys, which maps each API key to
+// the subject it authenticates as.
+func NewAPIKeys(keys map[string]string) *APIKeys {
+	a := &APIKeys{subjects: make(map[[sha256.Size]byte]string, len(keys))}
+	for key, subject := range keys {
+		a.subjects[sha256.Sum256([]byte(key))] = subject
+	}
+	return a
+}
+
+// Authenticate returns the subject of the request's API key. ok is false if
+// the request doesn't have one, and an unknown key is an error.
+func (a *APIKeys) Authenticate(ctx context.Context) (subject string, ok bool, err error) {
+	key := header(ctx, APIKeyHeader)
+	if key == "" {
+		return "", false, nil
+	}
+
+	subject, found := a.subjects[sha256.Sum256([]byte(key))]
+	if !found {
+		return "", false, status.Error(codes.Unauthenticated, "unknown api key")
+	}
+
+	return subject, true, nil
+}
+
+type JWTConfig struct {
+	// JWKSFile is a JSON web key set with the keys tokens are signed with,
+	// tokens name their key with the kid header.
+	JWKSFile string
+	// Issuer and Audience are checked against the tokens' claims if set.
+	Issuer   string
+	Audience string
+}
+
+// JWT authenticates clients by bearer tokens, taking the subject from the
+// token's sub claim. Tokens have to carry an expiry.
+type JWT struct {
+	config JWTConfig
+	keys   jose.JSONWebKeySet
+}
+
+func NewJWT(config JWTConfig) (*JWT, error) {
+	b, err := ioutil.ReadFile(config.JWKSFile)
+	if err != nil {
+		return nil, err
+	}
+
+	j := &JWT{config: config}
+	if err := json.Unmarshal(b, &j.keys); err != nil {
+		return nil, fmt.Errorf("parsing jwks: %w", err)
+	}
+
+	return j, nil
+}
+
+// Authenticate validates the request's bearer token and returns its subject.
+// ok is false if the request doesn't have a token, and an invalid token is
+// an error.
+func (j *JWT) Authenticate(ctx context.Context) (subject string, ok bool, err error) {
+	value := header(ctx, AuthorizationHeader)
+	if len(value) < len(bearerPrefix) || !strings.EqualFold(value[:len(bearerPrefix)], bearerPrefix) {
+		return "", false, nil
+	}
+
+	subject, err = j.validate(value[len(bearerPrefix):])
+	if err != nil {
+		msg := fmt.Sprintf("invalid bearer token: %s", err)
+		return "", false, status.Error(codes.Unauthenticated, msg)
+	}
+
+	return subject, true, nil
+}
+
+func (j *JWT) validate(raw string) (string, error) {
+	token, err := jwt.ParseSigned(raw)
+	if err != nil {
+		return "", err
+	}
+
+	if len(token.Headers) == 0 {
+		return "", fmt.Errorf("token has no header")
+	}
+
+	keys := j.keys.Key(token.Headers[0].KeyID)
+	if len(keys) == 0 {
+		return "", fmt.Errorf("unknown key: %q", token.Headers[0].KeyID)
+	}
+
+	var claims jwt.Claims
+	if err := token.Claims(keys[0].Key, &claims); err != nil {
+		return "", err
+	}
+
+	expected := jwt.Expected{
+		Issuer: j.config.Issuer,
+		Time:   time.Now(),
+	}
+	if j.config.Audience != "" {
+		expected.Audience = jwt.Audience{j.config.Audience}
+	}
+
+	if err := claims.ValidateWithLeeway(expected, jwt.DefaultLeeway); err != nil {
+		return "", err
+	}
+
+	// tokens without an expiry would be good forever.
+	if claims.Expiry == nil {
+		return "", fmt.Errorf("token has no expiry")
+	}
+
+	if claims.Subject == "" {
+		return "", fmt.Errorf("token has no subject")
+	}
+
+	return claims.Subject, nil
+}
+
+// header returns the first value of the request's metadata key.
+func header(ctx context.Context, key string) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+
+	values := md.Get(key)
+	if len(values) == 0 {
+		return ""
+	}
+
+	return values[0]
+}
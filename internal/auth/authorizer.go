@@ -2,25 +2,44 @@ package auth
 
 import (
 	"fmt"
+	"strings"
+	"sync"
 
 	"github.com/casbin/casbin"
+	"github.com/nireo/dilog/internal/watch"
+	"go.uber.org/zap"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
 type Authorizer struct {
+	model  string
+	policy string
+
+	mu       sync.RWMutex
 	enforcer *casbin.Enforcer
+
+	logger  *zap.Logger
+	watcher *watch.Watcher
+	audit   AuditLog
 }
 
 func New(model, policy string) *Authorizer {
 	enforcer := casbin.NewEnforcer(model, policy)
 	return &Authorizer{
+		model:    model,
+		policy:   policy,
 		enforcer: enforcer,
+		logger:   zap.L().Named("acl"),
 	}
 }
 
 func (a *Authorizer) Authorize(subject, object, action string) error {
-	if !a.enforcer.Enforce(subject, object, action) {
+	a.mu.RLock()
+	allowed := a.enforcer.Enforce(subject, object, action)
+	a.mu.RUnlock()
+
+	if !allowed {
 		msg := fmt.Sprintf("%s not permitted to %s to %s", subject, action, object)
 		st := status.New(codes.PermissionDenied, msg)
 
@@ -29,3 +48,78 @@ func (a *Authorizer) Authorize(subject, object, action string) error {
 
 	return nil
 }
+
+// Reload reads the model and policy files again and swaps them in. If they
+// don't parse, the previous policy stays in effect. Every attempt is logged
+// along with who made it. It returns the number of rules in
+// the policy.
+func (a *Authorizer) Reload(actor string) (int, error) {
+	enforcer, rules, err := newEnforcer(a.model, a.policy)
+	if err != nil {
+		a.logger.Warn(
+			"acl policy rejected",
+			zap.String("actor", actor),
+			zap.String("policy", a.policy),
+			zap.Error(err),
+		)
+		return 0, status.Error(codes.InvalidArgument, fmt.Sprintf("invalid acl policy: %s", err))
+	}
+
+	a.mu.Lock()
+	a.enforcer = enforcer
+	a.mu.Unlock()
+
+	a.logger.Info(
+		"acl policy reloaded",
+		zap.String("actor", actor),
+		zap.String("policy", a.policy),
+		zap.Int("rules", rules),
+	)
+
+	return rules, nil
+}
+
+// newEnforcer builds an enforcer, returning an error instead of panicking or
+// silently dropping rules when the model or policy is invalid. It also
+// returns the number of rules in the policy.
+func newEnforcer(model, policy string) (e *casbin.Enforcer, rules int, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			e, rules, err = nil, 0, fmt.Errorf("%v", r)
+		}
+	}()
+
+	e = casbin.NewEnforcer(model, policy)
+
+	// NewEnforcer ignores errors loading the policy, so load it again.
+	if err = e.LoadPolicy(); err != nil {
+		return nil, 0, err
+	}
+
+	m := e.GetModel()
+	for _, sec := range []string{"p", "g"} {
+		for key, ast := range m[sec] {
+			// only request and policy definitions have tokens, role
+			// definitions are written as "_, _".
+			fields := len(ast.Tokens)
+			if sec == "g" {
+				fields = strings.Count(ast.Value, "_")
+			}
+
+			for _, rule := range ast.Policy {
+				rules++
+				if len(rule) != fields {
+					return nil, 0, fmt.Errorf(
+						"rule %q has %d fields, %s takes %d",
+						key+", "+strings.Join(rule, ", "),
+						len(rule),
+						key,
+						fields,
+					)
+				}
+			}
+		}
+	}
+
+	return e, rules, nil
+}
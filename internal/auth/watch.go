@@ -0,0 +1,77 @@
+package auth
+
+import (
+	"time"
+
+	"github.com/nireo/dilog/internal/watch"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/status"
+
+	api "github.com/nireo/dilog/api/v1"
+)
+
+const (
+	// watcherActor is who reloads made because the files changed are
+	// logged and audited as.
+	watcherActor = "file watcher"
+
+	// reloadMethod, aclObject and adminAction describe the audit entries of
+	// reloads made by the watcher, like those of the ReloadACL call.
+	reloadMethod = "acl/Reload"
+	aclObject    = "acl"
+	adminAction  = "admin"
+)
+
+// AuditLog records the policy reloads the authorizer makes on its own.
+type AuditLog interface {
+	Record(entry *api.AuditEntry) error
+}
+
+// SetAudit makes the authorizer record every reload its watcher makes in
+// the audit log, besides logging it. Reloads made through ReloadACL are
+// recorded along with the call.
+func (a *Authorizer) SetAudit(audit AuditLog) {
+	a.audit = audit
+}
+
+// Watch reloads the policy whenever the model or policy file changes, until
+// the authorizer is closed.
+func (a *Authorizer) Watch() error {
+	w, err := watch.Files([]string{a.model, a.policy}, a.logger, a.reloadChanged)
+	if err != nil {
+		return err
+	}
+
+	a.watcher = w
+	return nil
+}
+
+// reloadChanged reloads the policy after its files changed. Rejected
+// policies are logged by Reload.
+func (a *Authorizer) reloadChanged() {
+	_, err := a.Reload(watcherActor)
+	if a.audit == nil {
+		return
+	}
+
+	err = a.audit.Record(&api.AuditEntry{
+		Time:    time.Now().UnixNano(),
+		Subject: watcherActor,
+		Action:  adminAction,
+		Object:  aclObject,
+		Method:  reloadMethod,
+		Result:  status.Code(err).String(),
+	})
+	if err != nil {
+		a.logger.Error("failed to record acl reload", zap.Error(err))
+	}
+}
+
+// Close stops watching the files.
+func (a *Authorizer) Close() error {
+	if a.watcher == nil {
+		return nil
+	}
+
+	return a.watcher.Close()
+}
@@ -0,0 +1,196 @@
+package config
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// DefaultCertValidity matches the expiry of the cfssl profiles in test.
+	DefaultCertValidity = 8760 * time.Hour
+
+	certKeyBits = 2048
+)
+
+var (
+	// DefaultCertHosts are the names the server certificate is valid for
+	// unless others are given.
+	DefaultCertHosts = []string{"localhost", "127.0.0.1"}
+
+	// ErrCertsExist is returned when generating certificates would overwrite
+	// an existing CA.
+	ErrCertsExist = errors.New("certificates already exist")
+)
+
+type CertsConfig struct {
+	// Dir is where the certificates and keys are written, defaults to the
+	// config directory.
+	Dir string
+	// Hosts are the DNS names and IP addresses the server certificate is
+	// valid for, defaults to DefaultCertHosts.
+	Hosts []string
+	// Validity defaults to DefaultCertValidity.
+	Validity time.Duration
+	// Force overwrites an existing CA.
+	Force bool
+}
+
+// GenerateCerts creates a development CA along with a server certificate
+// and the root and nobody client certificates the tests use, in the files
+// CAFile, ServerCertFile, RootClientCertFile and so on point to when Dir is
+// the config directory.
+func GenerateCerts(c CertsConfig) error {
+	if c.Dir == "" {
+		c.Dir = Dir()
+	}
+	if len(c.Hosts) == 0 {
+		c.Hosts = DefaultCertHosts
+	}
+	if c.Validity == 0 {
+		c.Validity = DefaultCertValidity
+	}
+
+	if !c.Force {
+		if _, err := os.Stat(filepath.Join(c.Dir, "ca.pem")); err == nil {
+			return ErrCertsExist
+		}
+	}
+
+	if err := os.MkdirAll(c.Dir, 0755); err != nil {
+		return err
+	}
+
+	caKey, err := rsa.GenerateKey(rand.Reader, certKeyBits)
+	if err != nil {
+		return err
+	}
+
+	caTemplate, err := certTemplate("Dilog CA", "CA Services", c.Validity)
+	if err != nil {
+		return err
+	}
+	caTemplate.IsCA = true
+	caTemplate.BasicConstraintsValid = true
+	caTemplate.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature
+
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		return err
+	}
+
+	if err := writeKeyPair(c.Dir, "ca", caDER, caKey); err != nil {
+		return err
+	}
+
+	certs := []struct {
+		name  string
+		cn    string
+		usage x509.ExtKeyUsage
+		hosts []string
+	}{
+		{name: "server", cn: "127.0.0.1", usage: x509.ExtKeyUsageServerAuth, hosts: c.Hosts},
+		{name: "root-client", cn: "root", usage: x509.ExtKeyUsageClientAuth},
+		{name: "nobody-client", cn: "nobody", usage: x509.ExtKeyUsageClientAuth},
+	}
+
+	for _, cert := range certs {
+		key, err := rsa.GenerateKey(rand.Reader, certKeyBits)
+		if err != nil {
+			return err
+		}
+
+		template, err := certTemplate(cert.cn, "Distributed Services", c.Validity)
+		if err != nil {
+			return err
+		}
+		template.KeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
+		template.ExtKeyUsage = []x509.ExtKeyUsage{cert.usage}
+
+		for _, host := range cert.hosts {
+			if ip := net.ParseIP(host); ip != nil {
+				template.IPAddresses = append(template.IPAddresses, ip)
+			} else {
+				template.DNSNames = append(template.DNSNames, host)
+			}
+		}
+
+		der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+		if err != nil {
+			return err
+		}
+
+		if err := writeKeyPair(c.Dir, cert.name, der, key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func certTemplate(cn, unit string, validity time.Duration) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:         cn,
+			Country:            []string{"FI"},
+			Province:           []string{"Uusimaa"},
+			Locality:           []string{"Helsinki"},
+			Organization:       []string{"Non existing"},
+			OrganizationalUnit: []string{unit},
+		},
+		// allow for some clock skew between the machines.
+		NotBefore: now.Add(-time.Hour),
+		NotAfter:  now.Add(validity),
+	}, nil
+}
+
+// writeKeyPair writes the certificate to name.pem and the key to
+// name-key.pem like cfssljson does.
+func writeKeyPair(dir, name string, der []byte, key *rsa.PrivateKey) error {
+	err := writePEM(filepath.Join(dir, name+".pem"), "CERTIFICATE", der, 0644)
+	if err != nil {
+		return err
+	}
+
+	return writePEM(
+		filepath.Join(dir, name+"-key.pem"),
+		"RSA PRIVATE KEY",
+		x509.MarshalPKCS1PrivateKey(key),
+		0600,
+	)
+}
+
+func writePEM(path, typ string, b []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	if err := pem.Encode(f, &pem.Block{Type: typ, Bytes: b}); err != nil {
+		f.Close()
+		return fmt.Errorf("writing %s: %w", path, err)
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,130 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func readCert(t *testing.T, path string) *x509.Certificate {
+	t.Helper()
+
+	b, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+
+	block, _ := pem.Decode(b)
+	require.NotNil(t, block, "no pem block in %s", path)
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	require.NoError(t, err)
+	return cert
+}
+
+func TestGenerateCerts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, GenerateCerts(CertsConfig{Dir: dir}))
+
+	ca := readCert(t, filepath.Join(dir, "ca.pem"))
+	require.True(t, ca.IsCA)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	for name, tc := range map[string]struct {
+		cn    string
+		usage x509.ExtKeyUsage
+		hosts []string
+	}{
+		"server":        {cn: "127.0.0.1", usage: x509.ExtKeyUsageServerAuth, hosts: DefaultCertHosts},
+		"root-client":   {cn: "root", usage: x509.ExtKeyUsageClientAuth},
+		"nobody-client": {cn: "nobody", usage: x509.ExtKeyUsageClientAuth},
+	} {
+		t.Run(name, func(t *testing.T) {
+			cert := readCert(t, filepath.Join(dir, name+".pem"))
+			require.Equal(t, tc.cn, cert.Subject.CommonName)
+
+			opts := x509.VerifyOptions{
+				Roots:     roots,
+				KeyUsages: []x509.ExtKeyUsage{tc.usage},
+			}
+			_, err := cert.Verify(opts)
+			require.NoError(t, err)
+
+			for _, host := range tc.hosts {
+				opts.DNSName = host
+				_, err := cert.Verify(opts)
+				require.NoError(t, err, host)
+			}
+
+			_, err = tls.LoadX509KeyPair(
+				filepath.Join(dir, name+".pem"),
+				filepath.Join(dir, name+"-key.pem"),
+			)
+			require.NoError(t, err)
+		})
+	}
+
+	// an existing CA is only overwritten when forced.
+	before, err := ioutil.ReadFile(filepath.Join(dir, "ca.pem"))
+	require.NoError(t, err)
+
+	require.Equal(t, ErrCertsExist, GenerateCerts(CertsConfig{Dir: dir}))
+	after, err := ioutil.ReadFile(filepath.Join(dir, "ca.pem"))
+	require.NoError(t, err)
+	require.Equal(t, before, after)
+
+	require.NoError(t, GenerateCerts(CertsConfig{Dir: dir, Force: true}))
+	after, err = ioutil.ReadFile(filepath.Join(dir, "ca.pem"))
+	require.NoError(t, err)
+	require.NotEqual(t, before, after)
+}
+
+func TestGenerateCertsSetupTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, GenerateCerts(CertsConfig{Dir: dir}))
+
+	serverConfig, err := SetupTLSConfig(TLSConfig{
+		CertFile: filepath.Join(dir, "server.pem"),
+		KeyFile:  filepath.Join(dir, "server-key.pem"),
+		CAFile:   filepath.Join(dir, "ca.pem"),
+		Server:   true,
+	})
+	require.NoError(t, err)
+
+	clientConfig, err := SetupTLSConfig(TLSConfig{
+		CertFile:      filepath.Join(dir, "root-client.pem"),
+		KeyFile:       filepath.Join(dir, "root-client-key.pem"),
+		CAFile:        filepath.Join(dir, "ca.pem"),
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+
+	// the generated certificates are good for a mutual TLS handshake.
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	server := tls.Server(serverConn, serverConfig)
+	errc := make(chan error, 1)
+	go func() { errc <- server.Handshake() }()
+
+	client := tls.Client(clientConn, clientConfig)
+	require.NoError(t, client.Handshake())
+	require.NoError(t, <-errc)
+
+	peers := server.ConnectionState().PeerCertificates
+	require.NotEmpty(t, peers)
+	require.Equal(t, "root", peers[0].Subject.CommonName)
+}
@@ -17,14 +17,20 @@ var (
 	ACLPolicyFile        = configFile("policy.csv")
 )
 
-func configFile(filename string) string {
+// Dir returns the config directory, CONFIG_DIR if it's set and ~/.dilog
+// otherwise.
+func Dir() string {
 	if dir := os.Getenv("CONFIG_DIR"); dir != "" {
-		return filepath.Join(dir, filename)
+		return dir
 	}
 	homeDir, err := os.UserHomeDir()
 	if err != nil {
 		panic(err)
 	}
 
-	return filepath.Join(homeDir, ".dilog", filename)
+	return filepath.Join(homeDir, ".dilog")
+}
+
+func configFile(filename string) string {
+	return filepath.Join(Dir(), filename)
 }
@@ -0,0 +1,184 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"github.com/nireo/dilog/internal/watch"
+	"go.uber.org/zap"
+)
+
+// TLSReloader keeps the key pair and CA of the TLS configs it returns up to
+// date with their files, so short-lived certificates can be renewed and CAs
+// rotated without restarting.
+type TLSReloader struct {
+	config TLSConfig
+	logger *zap.Logger
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+	ca   *x509.CertPool
+
+	watcher *watch.Watcher
+}
+
+// NewTLSReloader loads the config's files, which keep being used until
+// Reload or the watcher started by Watch loads them again.
+func NewTLSReloader(config TLSConfig) (*TLSReloader, error) {
+	r := &TLSReloader{
+		config: config,
+		logger: zap.L().Named("tls"),
+	}
+
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Reload loads the key pair and CA files again. If either fails to load,
+// the previous ones stay in use.
+func (r *TLSReloader) Reload() error {
+	var cert *tls.Certificate
+	if r.config.CertFile != "" && r.config.KeyFile != "" {
+		c, err := tls.LoadX509KeyPair(r.config.CertFile, r.config.KeyFile)
+		if err != nil {
+			return err
+		}
+		cert = &c
+	}
+
+	var ca *x509.CertPool
+	if r.config.CAFile != "" {
+		b, err := ioutil.ReadFile(r.config.CAFile)
+		if err != nil {
+			return err
+		}
+
+		ca = x509.NewCertPool()
+		if !ca.AppendCertsFromPEM(b) {
+			return fmt.Errorf("failed to parse root certificate: %q", r.config.CAFile)
+		}
+	}
+
+	r.mu.Lock()
+	r.cert = cert
+	r.ca = ca
+	r.mu.Unlock()
+
+	return nil
+}
+
+// TLSConfig returns a config that uses the currently loaded files for each
+// handshake.
+//
+// Servers get the CA through GetConfigForClient, so callers setting fields
+// like NextProtos on a clone of the config have to set them on the configs it
+// returns too. Clients verify the server against the CA in VerifyConnection
+// instead of through RootCAs, which can't change once a connection is set up.
+func (r *TLSReloader) TLSConfig() *tls.Config {
+	tlsConfig := &tls.Config{ServerName: r.config.ServerAddress}
+
+	if r.config.CertFile != "" && r.config.KeyFile != "" {
+		if r.config.Server {
+			tlsConfig.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+				return r.certificate(), nil
+			}
+		} else {
+			tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				return r.certificate(), nil
+			}
+		}
+	}
+
+	if r.config.CAFile == "" {
+		return tlsConfig
+	}
+
+	if r.config.Server {
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		tlsConfig.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			c := tlsConfig.Clone()
+			c.GetConfigForClient = nil
+			c.ClientCAs = r.pool()
+			return c, nil
+		}
+	} else {
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyConnection = r.verifyServer
+	}
+
+	return tlsConfig
+}
+
+// verifyServer does the verification InsecureSkipVerify turned off, against
+// the current CA.
+func (r *TLSReloader) verifyServer(state tls.ConnectionState) error {
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("server didn't send a certificate")
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{
+		Roots:         r.pool(),
+		Intermediates: intermediates,
+		DNSName:       state.ServerName,
+	})
+	return err
+}
+
+func (r *TLSReloader) certificate() *tls.Certificate {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert
+}
+
+func (r *TLSReloader) pool() *x509.CertPool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.ca
+}
+
+// Watch reloads the files whenever they change, until the reloader is
+// closed.
+func (r *TLSReloader) Watch() error {
+	files := []string{r.config.CertFile, r.config.KeyFile, r.config.CAFile}
+	w, err := watch.Files(files, r.logger, r.reloadChanged)
+	if err != nil {
+		return err
+	}
+
+	r.watcher = w
+	return nil
+}
+
+// reloadChanged reloads the files after they changed.
+func (r *TLSReloader) reloadChanged() {
+	if err := r.Reload(); err != nil {
+		r.logger.Error(
+			"failed to reload tls files, keeping the previous ones",
+			zap.String("cert", r.config.CertFile),
+			zap.Error(err),
+		)
+		return
+	}
+	r.logger.Info("reloaded tls files", zap.String("cert", r.config.CertFile))
+}
+
+// Close stops watching the files.
+func (r *TLSReloader) Close() error {
+	if r.watcher == nil {
+		return nil
+	}
+
+	return r.watcher.Close()
+}
@@ -0,0 +1,220 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const defaultDNSInterval = 30 * time.Second
+
+// Resolver looks up SRV and TXT records, it's satisfied by *net.Resolver.
+type Resolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+type DNSConfig struct {
+	NodeName string
+	Tags     map[string]string
+	// Name is the SRV record listing the cluster's nodes. Each target is
+	// used as the node's name and its port as the node's RPC port, so nodes
+	// should be named after their host names. A target's TXT records of
+	// key=value strings are its other tags, such as zone=eu-west-1a, and
+	// should be set for every node so they agree on where logs are placed.
+	Name string
+	// Interval is how often the record is looked up again.
+	Interval time.Duration
+	Resolver Resolver
+}
+
+var _ Membership = (*DNS)(nil)
+
+// DNS discovers members by periodically looking up an SRV record. Targets
+// that appear in the record are joined and ones that disappear are left.
+type DNS struct {
+	DNSConfig
+	handler Handler
+	logger  *zap.Logger
+
+	mu      sync.Mutex
+	members map[string]Member
+	left    bool
+	stop    chan struct{}
+}
+
+func NewDNS(handler Handler, config DNSConfig) (*DNS, error) {
+	if config.Interval == 0 {
+		config.Interval = defaultDNSInterval
+	}
+
+	if config.Resolver == nil {
+		config.Resolver = net.DefaultResolver
+	}
+
+	d := &DNS{
+		DNSConfig: config,
+		handler:   handler,
+		logger:    zap.L().Named("membership"),
+		members:   make(map[string]Member),
+		stop:      make(chan struct{}),
+	}
+
+	if err := d.refresh(); err != nil {
+		return nil, err
+	}
+
+	go d.poll()
+	return d, nil
+}
+
+func (d *DNS) poll() {
+	ticker := time.NewTicker(d.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+			if err := d.refresh(); err != nil {
+				d.logger.Error("failed to look up members", zap.Error(err),
+					zap.String("name", d.Name))
+			}
+		}
+	}
+}
+
+// refresh looks up the SRV record and the targets' TXT records, and tells the
+// handler about the members that were added, changed or removed since the
+// last lookup.
+func (d *DNS) refresh() error {
+	ctx, cancel := context.WithTimeout(context.Background(), d.Interval)
+	defer cancel()
+
+	_, records, err := d.Resolver.LookupSRV(ctx, "", "", d.Name)
+	if err != nil {
+		return err
+	}
+
+	found := make(map[string]Member)
+	for _, record := range records {
+		name := strings.TrimSuffix(record.Target, ".")
+		if name == d.NodeName {
+			continue
+		}
+
+		tags, err := d.tags(ctx, record.Target)
+		if err != nil {
+			return err
+		}
+		tags[TagRPCAddr] = net.JoinHostPort(name, strconv.Itoa(int(record.Port)))
+		found[name] = Member{Name: name, Tags: tags}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for name, member := range found {
+		if old, ok := d.members[name]; ok && equalTags(old.Tags, member.Tags) {
+			continue
+		}
+
+		if err := join(d.handler, member); err != nil {
+			d.logger.Error("failed to join", zap.Error(err),
+				zap.String("name", name), zap.String("rpc_addr", member.RPCAddr()))
+		}
+	}
+
+	for name, member := range d.members {
+		if _, ok := found[name]; ok {
+			continue
+		}
+
+		if err := d.handler.Leave(name); err != nil {
+			d.logger.Error("failed to leave", zap.Error(err),
+				zap.String("name", name), zap.String("rpc_addr", member.RPCAddr()))
+		}
+	}
+
+	d.members = found
+	return nil
+}
+
+// tags returns the tags in the target's TXT records. Targets without any
+// have no tags.
+func (d *DNS) tags(ctx context.Context, target string) (map[string]string, error) {
+	tags := make(map[string]string)
+
+	txts, err := d.Resolver.LookupTXT(ctx, target)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return tags, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, txt := range txts {
+		kv := strings.SplitN(txt, "=", 2)
+		if len(kv) != 2 || kv[0] == TagRPCAddr {
+			continue
+		}
+		tags[kv[0]] = kv[1]
+	}
+
+	return tags, nil
+}
+
+func equalTags(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || v != w {
+			return false
+		}
+	}
+	return true
+}
+
+func (d *DNS) Members() []Member {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	local := Member{Name: d.NodeName, Tags: d.Tags, Status: StatusAlive}
+	if d.left {
+		local.Status = StatusLeft
+	}
+
+	members := []Member{local}
+	for _, member := range d.members {
+		member.Status = StatusAlive
+		members = append(members, member)
+	}
+
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].Name < members[j].Name
+	})
+
+	return members
+}
+
+func (d *DNS) Leave() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !d.left {
+		d.left = true
+		close(d.stop)
+	}
+
+	return nil
+}
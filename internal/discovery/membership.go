@@ -1,121 +1,100 @@
 package discovery
 
-import (
-	"net"
-
-	"github.com/hashicorp/serf/serf"
-	"go.uber.org/zap"
-)
-
 type Handler interface {
 	Join(name, addr string) error
 	Leave(name string) error
 }
 
-type Config struct {
-	NodeName       string
-	BindAddr       string
-	Tags           map[string]string
-	StartJoinAddrs []string
+// MemberHandler is implemented by handlers that want the joining member's
+// tags rather than just its RPC address. Backends call JoinMember instead of
+// Join when the handler implements it.
+type MemberHandler interface {
+	JoinMember(member Member) error
 }
 
-type Membership struct {
-	Config
-	handler Handler
-	serf    *serf.Serf
-	events  chan serf.Event
-	logger  *zap.Logger
+// FailureHandler is implemented by handlers that treat members failing
+// differently from leaving. Backends that can tell them apart call Fail
+// instead of Leave when the handler implements it.
+type FailureHandler interface {
+	Fail(name string) error
 }
 
-func (m *Membership) setupSerf() (err error) {
-	addr, err := net.ResolveTCPAddr("tcp", m.BindAddr)
-	if err != nil {
-		return err
-	}
-
-	config := serf.DefaultConfig()
-	config.Init()
-	config.MemberlistConfig.BindAddr = addr.IP.String()
-	config.MemberlistConfig.BindPort = addr.Port
-	m.events = make(chan serf.Event)
-	config.EventCh = m.events
-	config.Tags = m.Tags
-	config.NodeName = m.Config.NodeName
-	m.serf, err = serf.Create(config)
-	if err != nil {
-		return err
-	}
-	go m.eventHandler()
-	if m.StartJoinAddrs != nil {
-		_, err = m.serf.Join(m.StartJoinAddrs, true)
-		if err != nil {
-			return err
-		}
+func join(handler Handler, member Member) error {
+	if h, ok := handler.(MemberHandler); ok {
+		return h.JoinMember(member)
 	}
+	return handler.Join(member.Name, member.RPCAddr())
+}
 
-	return nil
+// Membership is a discovery backend. It tells its handler whenever another
+// node joins or leaves the cluster.
+type Membership interface {
+	Members() []Member
+	Leave() error
 }
 
-func New(handler Handler, config Config) (*Membership, error) {
-	c := &Membership{
-		Config:  config,
-		handler: handler,
-		logger:  zap.L().Named("membership"),
-	}
+type MemberStatus int
 
-	if err := c.setupSerf(); err != nil {
-		return nil, err
-	}
+const (
+	StatusAlive MemberStatus = iota
+	StatusLeaving
+	StatusLeft
+	StatusFailed
+)
 
-	return c, nil
+func (s MemberStatus) String() string {
+	switch s {
+	case StatusAlive:
+		return "alive"
+	case StatusLeaving:
+		return "leaving"
+	case StatusLeft:
+		return "left"
+	case StatusFailed:
+		return "failed"
+	}
+	return "unknown"
 }
 
-func (m *Membership) eventHandler() {
-	for e := range m.events {
-		switch e.EventType() {
-		case serf.EventMemberJoin:
-			for _, member := range e.(serf.MemberEvent).Members {
-				if m.isLocal(member) {
-					continue
-				}
-				m.handleJoin(member)
-			}
-		case serf.EventMemberLeave, serf.EventMemberFailed:
-			for _, member := range e.(serf.MemberEvent).Members {
-				if m.isLocal(member) {
-					return
-				}
-				m.handleLeave(member)
-			}
-		}
-	}
+// Tags every member advertises about itself. Only TagRPCAddr is required.
+const (
+	TagRPCAddr  = "rpc_addr"
+	TagHTTPAddr = "http_addr"
+	TagRole     = "role"
+	TagVersion  = "version"
+	TagZone     = "zone"
+	TagRack     = "rack"
+)
+
+// Member is a node in the cluster, including the local one.
+type Member struct {
+	Name   string
+	Tags   map[string]string
+	Status MemberStatus
 }
 
-func (m *Membership) handleJoin(member serf.Member) {
-	if err := m.handler.Join(member.Name, member.Tags["rpc_addr"]); err != nil {
-		m.logError(err, "failed to join", member)
-	}
+// RPCAddr returns the address the member serves its log on.
+func (m Member) RPCAddr() string {
+	return m.Tags[TagRPCAddr]
 }
 
-func (m *Membership) handleLeave(member serf.Member) {
-	if err := m.handler.Leave(member.Name); err != nil {
-		m.logError(err, "failed to leave", member)
-	}
+func (m Member) HTTPAddr() string {
+	return m.Tags[TagHTTPAddr]
 }
 
-func (m *Membership) isLocal(member serf.Member) bool {
-	return m.serf.LocalMember().Name == member.Name
+func (m Member) Role() string {
+	return m.Tags[TagRole]
 }
 
-func (m *Membership) Members() []serf.Member {
-	return m.serf.Members()
+func (m Member) Version() string {
+	return m.Tags[TagVersion]
 }
 
-func (m *Membership) Leave() error {
-	return m.serf.Leave()
+// Zone returns the member's failure domain, empty if it didn't advertise one.
+func (m Member) Zone() string {
+	return m.Tags[TagZone]
 }
 
-func (m *Membership) logError(err error, msg string, member serf.Member) {
-	m.logger.Error(msg, zap.Error(err), zap.String("name", member.Name),
-		zap.String("rpc_addr", member.Tags["rpc_addr"]))
+func (m Member) Rack() string {
+	return m.Tags[TagRack]
 }
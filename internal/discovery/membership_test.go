@@ -1 +1,337 @@
 package discovery_test
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nireo/dilog/internal/discovery"
+	"github.com/travisjeffery/go-dynaport"
+)
+
+type handler struct {
+	mu     sync.Mutex
+	joins  map[string]string
+	leaves []string
+}
+
+func newHandler() *handler {
+	return &handler{joins: make(map[string]string)}
+}
+
+func (h *handler) Join(name, addr string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.joins[name] = addr
+
+	return nil
+}
+
+func (h *handler) Leave(name string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.leaves = append(h.leaves, name)
+
+	return nil
+}
+
+func (h *handler) counts() (joins, leaves int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return len(h.joins), len(h.leaves)
+}
+
+// eventually fails the test if cond doesn't hold within timeout.
+func eventually(t *testing.T, timeout time.Duration, cond func() bool, msg string) {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal(msg)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func setupSerf(t *testing.T, members []*discovery.Serf) (*discovery.Serf, *handler) {
+	t.Helper()
+
+	id := len(members)
+	ports := dynaport.Get(1)
+	addr := fmt.Sprintf("%s:%d", "127.0.0.1", ports[0])
+
+	c := discovery.Config{
+		NodeName: fmt.Sprintf("%d", id),
+		BindAddr: addr,
+		Tags:     map[string]string{"rpc_addr": addr},
+	}
+	if len(members) != 0 {
+		c.StartJoinAddrs = []string{members[0].BindAddr}
+	}
+
+	h := newHandler()
+	m, err := discovery.NewSerf(h, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return m, h
+}
+
+func memberStatus(m discovery.Membership, name string) discovery.MemberStatus {
+	for _, member := range m.Members() {
+		if member.Name == name {
+			return member.Status
+		}
+	}
+	return discovery.StatusLeft
+}
+
+func memberZone(m discovery.Membership, name string) string {
+	for _, member := range m.Members() {
+		if member.Name == name {
+			return member.Zone()
+		}
+	}
+	return ""
+}
+
+func TestSerfMembership(t *testing.T) {
+	var (
+		members  []*discovery.Serf
+		handlers []*handler
+	)
+	for i := 0; i < 3; i++ {
+		m, h := setupSerf(t, members)
+		members = append(members, m)
+		handlers = append(handlers, h)
+	}
+	defer func() {
+		for _, m := range members {
+			m.Shutdown()
+		}
+	}()
+
+	eventually(t, 5*time.Second, func() bool {
+		joins, leaves := handlers[0].counts()
+		return joins == 2 && leaves == 0 && len(members[0].Members()) == 3
+	}, "members didn't join")
+
+	if err := members[2].Leave(); err != nil {
+		t.Fatal(err)
+	}
+
+	eventually(t, 5*time.Second, func() bool {
+		_, leaves := handlers[0].counts()
+		return leaves == 1 && memberStatus(members[0], "2") == discovery.StatusLeft
+	}, "member didn't leave")
+
+	// the remaining members keep processing events after another leaves.
+	if err := members[1].Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	eventually(t, 30*time.Second, func() bool {
+		_, leaves := handlers[0].counts()
+		return leaves == 2 && memberStatus(members[0], "1") == discovery.StatusFailed
+	}, "member failure wasn't detected")
+}
+
+func TestStaticMembership(t *testing.T) {
+	h := newHandler()
+	m, err := discovery.NewStatic(h, discovery.StaticConfig{
+		NodeName: "0",
+		Tags:     map[string]string{"rpc_addr": "127.0.0.1:8400"},
+		Peers: map[string]string{
+			"0": "127.0.0.1:8400",
+			"1": "127.0.0.1:8401",
+			"2": "127.0.0.1:8402",
+		},
+		PeerTags: map[string]map[string]string{
+			"1": {discovery.TagZone: "a"},
+			"2": {discovery.TagZone: "b"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if joins, _ := h.counts(); joins != 2 {
+		t.Fatalf("got %d joins, want: 2", joins)
+	}
+
+	if h.joins["1"] != "127.0.0.1:8401" {
+		t.Fatalf("got addr: %s, want: 127.0.0.1:8401", h.joins["1"])
+	}
+
+	members := m.Members()
+	if len(members) != 3 {
+		t.Fatalf("got %d members, want: 3", len(members))
+	}
+
+	// the peers have their configured tags along with their address.
+	for _, member := range members[1:] {
+		if member.RPCAddr() != "127.0.0.1:840"+member.Name {
+			t.Fatalf("got addr: %s for member %s", member.RPCAddr(), member.Name)
+		}
+	}
+	if zone := members[1].Zone(); zone != "a" {
+		t.Fatalf("got zone: %q, want: a", zone)
+	}
+	if zone := members[2].Zone(); zone != "b" {
+		t.Fatalf("got zone: %q, want: b", zone)
+	}
+
+	if err = m.Leave(); err != nil {
+		t.Fatal(err)
+	}
+
+	if status := memberStatus(m, "0"); status != discovery.StatusLeft {
+		t.Fatalf("got status: %s, want: %s", status, discovery.StatusLeft)
+	}
+}
+
+type resolver struct {
+	mu      sync.Mutex
+	records []*net.SRV
+	txts    map[string][]string
+}
+
+func (r *resolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return name, r.records, nil
+}
+
+func (r *resolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	txts, ok := r.txts[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return txts, nil
+}
+
+func (r *resolver) setTXT(name string, txts ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.txts == nil {
+		r.txts = make(map[string][]string)
+	}
+	r.txts[name] = txts
+}
+
+func (r *resolver) set(records ...*net.SRV) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.records = records
+}
+
+func TestDNSMembership(t *testing.T) {
+	r := &resolver{}
+	r.set(
+		&net.SRV{Target: "node-0.dilog.local.", Port: 8400},
+		&net.SRV{Target: "node-1.dilog.local.", Port: 8400},
+	)
+	r.setTXT("node-1.dilog.local.", "zone=a", "rack=1")
+
+	h := newHandler()
+	m, err := discovery.NewDNS(h, discovery.DNSConfig{
+		NodeName: "node-0.dilog.local",
+		Name:     "_dilog._tcp.dilog.local",
+		Interval: 50 * time.Millisecond,
+		Resolver: r,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Leave()
+
+	if joins, _ := h.counts(); joins != 1 {
+		t.Fatalf("got %d joins, want: 1", joins)
+	}
+
+	if addr := h.joins["node-1.dilog.local"]; addr != "node-1.dilog.local:8400" {
+		t.Fatalf("got addr: %s, want: node-1.dilog.local:8400", addr)
+	}
+
+	// the target's TXT records are its tags.
+	if zone := memberZone(m, "node-1.dilog.local"); zone != "a" {
+		t.Fatalf("got zone: %q, want: a", zone)
+	}
+
+	r.setTXT("node-1.dilog.local.", "zone=b")
+	eventually(t, time.Second, func() bool {
+		return memberZone(m, "node-1.dilog.local") == "b"
+	}, "member didn't follow its TXT records")
+
+	r.set(
+		&net.SRV{Target: "node-0.dilog.local.", Port: 8400},
+		&net.SRV{Target: "node-2.dilog.local.", Port: 8400},
+	)
+
+	eventually(t, time.Second, func() bool {
+		joins, leaves := h.counts()
+		return joins == 2 && leaves == 1
+	}, "membership didn't follow the SRV record")
+
+	if len(m.Members()) != 2 {
+		t.Fatalf("got %d members, want: 2", len(m.Members()))
+	}
+}
+
+func TestSerfGossipEncryption(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(make([]byte, 32))
+
+	var members []*discovery.Serf
+	for i, keys := range [][]string{{key}, {key}, nil} {
+		ports := dynaport.Get(1)
+		addr := fmt.Sprintf("%s:%d", "127.0.0.1", ports[0])
+
+		c := discovery.Config{
+			NodeName:    fmt.Sprintf("%d", i),
+			BindAddr:    addr,
+			Tags:        map[string]string{discovery.TagRPCAddr: addr},
+			EncryptKeys: keys,
+		}
+		if i != 0 {
+			c.StartJoinAddrs = []string{members[0].BindAddr}
+		}
+
+		m, err := discovery.NewSerf(newHandler(), c)
+		if keys == nil {
+			// a member without the key can't join the encrypted cluster.
+			if err == nil {
+				m.Shutdown()
+				t.Fatal("joined without the gossip key")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer m.Shutdown()
+
+		members = append(members, m)
+	}
+
+	keys, err := members[0].ListKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if keys.NumNodes != 2 || keys.Keys[key] != 2 {
+		t.Fatalf("got keys: %v on %d nodes", keys.Keys, keys.NumNodes)
+	}
+}
@@ -0,0 +1,263 @@
+package discovery
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/hashicorp/serf/serf"
+	"go.uber.org/zap"
+)
+
+type Config struct {
+	NodeName       string
+	BindAddr       string
+	Tags           map[string]string
+	StartJoinAddrs []string
+	// EncryptKeys are base64 encoded 16, 24 or 32 byte keys that gossip is
+	// encrypted with. The first one encrypts outgoing messages, the rest are
+	// only tried when decrypting. Gossip is in plaintext if there are none.
+	EncryptKeys []string
+	// KeyringFile persists the keyring as keys are installed, used and
+	// removed. If it exists when the member starts, it replaces EncryptKeys.
+	KeyringFile string
+}
+
+var _ Membership = (*Serf)(nil)
+
+// Serf discovers members through serf's gossip protocol.
+type Serf struct {
+	Config
+	handler Handler
+	serf    *serf.Serf
+	events  chan serf.Event
+	logger  *zap.Logger
+}
+
+func (m *Serf) setupSerf() (err error) {
+	addr, err := net.ResolveTCPAddr("tcp", m.BindAddr)
+	if err != nil {
+		return err
+	}
+
+	config := serf.DefaultConfig()
+	config.Init()
+	config.MemberlistConfig.BindAddr = addr.IP.String()
+	config.MemberlistConfig.BindPort = addr.Port
+	config.MemberlistConfig.Keyring, err = m.keyring()
+	if err != nil {
+		return err
+	}
+	config.KeyringFile = m.KeyringFile
+	m.events = make(chan serf.Event)
+	config.EventCh = m.events
+	config.Tags = m.Tags
+	config.NodeName = m.Config.NodeName
+	m.serf, err = serf.Create(config)
+	if err != nil {
+		return err
+	}
+	go m.eventHandler()
+	if m.StartJoinAddrs != nil {
+		_, err = m.serf.Join(m.StartJoinAddrs, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func NewSerf(handler Handler, config Config) (*Serf, error) {
+	c := &Serf{
+		Config:  config,
+		handler: handler,
+		logger:  zap.L().Named("membership"),
+	}
+
+	if err := c.setupSerf(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (m *Serf) eventHandler() {
+	for e := range m.events {
+		switch e.EventType() {
+		case serf.EventMemberJoin:
+			for _, member := range e.(serf.MemberEvent).Members {
+				if m.isLocal(member) {
+					continue
+				}
+				m.handleJoin(member)
+			}
+		case serf.EventMemberLeave:
+			for _, member := range e.(serf.MemberEvent).Members {
+				if m.isLocal(member) {
+					continue
+				}
+				m.handleLeave(member)
+			}
+		case serf.EventMemberFailed:
+			for _, member := range e.(serf.MemberEvent).Members {
+				if m.isLocal(member) {
+					continue
+				}
+				m.handleFail(member)
+			}
+		}
+	}
+}
+
+// keyring builds the gossip keyring from the keyring file, or EncryptKeys if
+// the file doesn't exist yet. It's nil if gossip isn't encrypted.
+func (m *Serf) keyring() (*memberlist.Keyring, error) {
+	keys := m.EncryptKeys
+	if m.KeyringFile != "" {
+		b, err := ioutil.ReadFile(m.KeyringFile)
+		switch {
+		case err == nil:
+			keys = nil
+			if err := json.Unmarshal(b, &keys); err != nil {
+				return nil, err
+			}
+		case !os.IsNotExist(err):
+			return nil, err
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	decoded := make([][]byte, 0, len(keys))
+	for _, key := range keys {
+		b, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gossip key: %w", err)
+		}
+		decoded = append(decoded, b)
+	}
+
+	return memberlist.NewKeyring(decoded, decoded[0])
+}
+
+func (m *Serf) handleJoin(member serf.Member) {
+	if err := join(m.handler, toMember(member)); err != nil {
+		m.logError(err, "failed to join", member)
+	}
+}
+
+func (m *Serf) handleLeave(member serf.Member) {
+	if err := m.handler.Leave(member.Name); err != nil {
+		m.logError(err, "failed to leave", member)
+	}
+}
+
+func (m *Serf) handleFail(member serf.Member) {
+	h, ok := m.handler.(FailureHandler)
+	if !ok {
+		m.handleLeave(member)
+		return
+	}
+
+	if err := h.Fail(member.Name); err != nil {
+		m.logError(err, "failed to handle failure", member)
+	}
+}
+
+func (m *Serf) isLocal(member serf.Member) bool {
+	return m.serf.LocalMember().Name == member.Name
+}
+
+func (m *Serf) Members() []Member {
+	var members []Member
+	for _, member := range m.serf.Members() {
+		members = append(members, toMember(member))
+	}
+
+	return members
+}
+
+func toMember(member serf.Member) Member {
+	status := StatusAlive
+	switch member.Status {
+	case serf.StatusLeaving:
+		status = StatusLeaving
+	case serf.StatusLeft:
+		status = StatusLeft
+	case serf.StatusFailed:
+		status = StatusFailed
+	}
+
+	return Member{
+		Name:   member.Name,
+		Tags:   member.Tags,
+		Status: status,
+	}
+}
+
+// Keys describes the gossip keyring across the cluster.
+type Keys struct {
+	// Keys maps each base64 encoded key to the number of members that have
+	// it installed.
+	Keys map[string]int
+	// PrimaryKeys maps each base64 encoded key to the number of members
+	// encrypting with it.
+	PrimaryKeys map[string]int
+	NumNodes    int
+}
+
+// InstallKey adds the base64 encoded key to every member's keyring without
+// encrypting with it yet, so that it can be used once every member has it.
+func (m *Serf) InstallKey(key string) error {
+	_, err := m.serf.KeyManager().InstallKey(key)
+	return err
+}
+
+// UseKey makes every member encrypt gossip with the installed key.
+func (m *Serf) UseKey(key string) error {
+	_, err := m.serf.KeyManager().UseKey(key)
+	return err
+}
+
+// RemoveKey removes the key from every member's keyring. The key that's in
+// use can't be removed.
+func (m *Serf) RemoveKey(key string) error {
+	_, err := m.serf.KeyManager().RemoveKey(key)
+	return err
+}
+
+// ListKeys asks every member which keys it has installed.
+func (m *Serf) ListKeys() (*Keys, error) {
+	res, err := m.serf.KeyManager().ListKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Keys{
+		Keys:        res.Keys,
+		PrimaryKeys: res.PrimaryKeys,
+		NumNodes:    res.NumNodes,
+	}, nil
+}
+
+func (m *Serf) Leave() error {
+	return m.serf.Leave()
+}
+
+// Shutdown stops gossiping without leaving the cluster, which the other
+// members will notice as a failure.
+func (m *Serf) Shutdown() error {
+	return m.serf.Shutdown()
+}
+
+func (m *Serf) logError(err error, msg string, member serf.Member) {
+	m.logger.Error(msg, zap.Error(err), zap.String("name", member.Name),
+		zap.String("rpc_addr", member.Tags[TagRPCAddr]))
+}
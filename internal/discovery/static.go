@@ -0,0 +1,100 @@
+package discovery
+
+import (
+	"sort"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+type StaticConfig struct {
+	NodeName string
+	Tags     map[string]string
+	// Peers maps the name of every node in the cluster to its RPC address.
+	// The local node may be listed too, it's skipped.
+	Peers map[string]string
+	// PeerTags maps a peer's name to the tags it advertises besides its RPC
+	// address, such as its zone. Every node has to be given the same tags,
+	// or they won't agree on where logs are placed.
+	PeerTags map[string]map[string]string
+}
+
+var _ Membership = (*Static)(nil)
+
+// Static is a fixed list of members read from the configuration. Every peer
+// is joined when it's created and considered alive from then on.
+type Static struct {
+	StaticConfig
+	handler Handler
+	logger  *zap.Logger
+
+	mu   sync.Mutex
+	left bool
+}
+
+func NewStatic(handler Handler, config StaticConfig) (*Static, error) {
+	s := &Static{
+		StaticConfig: config,
+		handler:      handler,
+		logger:       zap.L().Named("membership"),
+	}
+
+	for name, addr := range s.Peers {
+		if name == s.NodeName {
+			continue
+		}
+
+		if err := join(s.handler, s.member(name, addr)); err != nil {
+			s.logger.Error("failed to join", zap.Error(err),
+				zap.String("name", name), zap.String("rpc_addr", addr))
+		}
+	}
+
+	return s, nil
+}
+
+func (s *Static) Members() []Member {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	local := Member{Name: s.NodeName, Tags: s.Tags, Status: StatusAlive}
+	if s.left {
+		local.Status = StatusLeft
+	}
+
+	members := []Member{local}
+	for name, addr := range s.Peers {
+		if name == s.NodeName {
+			continue
+		}
+
+		member := s.member(name, addr)
+		member.Status = StatusAlive
+		members = append(members, member)
+	}
+
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].Name < members[j].Name
+	})
+
+	return members
+}
+
+// member returns the peer with its configured tags.
+func (s *Static) member(name, addr string) Member {
+	tags := map[string]string{}
+	for k, v := range s.PeerTags[name] {
+		tags[k] = v
+	}
+	tags[TagRPCAddr] = addr
+
+	return Member{Name: name, Tags: tags}
+}
+
+func (s *Static) Leave() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.left = true
+	return nil
+}
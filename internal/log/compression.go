@@ -0,0 +1,155 @@
+package log
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+)
+
+// Codec identifies the compression algorithm applied to a record before it
+// is written to a segment's store.
+type Codec uint8
+
+const (
+	CodecNone Codec = iota
+	CodecGzip
+	CodecSnappy
+	CodecZstd
+)
+
+// compressionMarker prefixes every compressed payload. A marshalled record
+// can never start with a zero byte since protobuf field numbers start at one,
+// which lets segments hold both compressed and plain records.
+const compressionMarker byte = 0
+
+func (c Codec) String() string {
+	switch c {
+	case CodecNone:
+		return "none"
+	case CodecGzip:
+		return "gzip"
+	case CodecSnappy:
+		return "snappy"
+	case CodecZstd:
+		return "zstd"
+	}
+	return fmt.Sprintf("codec(%d)", uint8(c))
+}
+
+// ParseCodec returns the codec with the given name.
+func ParseCodec(name string) (Codec, error) {
+	switch name {
+	case "", "none":
+		return CodecNone, nil
+	case "gzip":
+		return CodecGzip, nil
+	case "snappy":
+		return CodecSnappy, nil
+	case "zstd":
+		return CodecZstd, nil
+	}
+	return CodecNone, fmt.Errorf("unknown compression codec: %q", name)
+}
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+func zstdCodec() (*zstd.Encoder, *zstd.Decoder, error) {
+	zstdOnce.Do(func() {
+		if zstdEncoder, zstdErr = zstd.NewWriter(nil); zstdErr != nil {
+			return
+		}
+		zstdDecoder, zstdErr = zstd.NewReader(nil)
+	})
+	return zstdEncoder, zstdDecoder, zstdErr
+}
+
+// compress encodes p with the codec and prepends the codec marker. If the
+// codec doesn't make the payload smaller, p is returned as is.
+func compress(codec Codec, p []byte) ([]byte, error) {
+	if codec == CodecNone || len(p) == 0 {
+		return p, nil
+	}
+
+	out := []byte{compressionMarker, byte(codec)}
+	switch codec {
+	case CodecGzip:
+		buf := bytes.NewBuffer(out)
+		w := gzip.NewWriter(buf)
+		if _, err := w.Write(p); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		out = buf.Bytes()
+	case CodecSnappy:
+		out = append(out, s2.EncodeSnappy(nil, p)...)
+	case CodecZstd:
+		enc, _, err := zstdCodec()
+		if err != nil {
+			return nil, err
+		}
+		out = enc.EncodeAll(p, out)
+	default:
+		return nil, fmt.Errorf("unknown compression codec: %d", codec)
+	}
+
+	if len(out) >= len(p) {
+		recordCompression(codec, len(p), len(p))
+		return p, nil
+	}
+	recordCompression(codec, len(p), len(out))
+	return out, nil
+}
+
+// decompress returns the original payload for p, which may or may not have
+// been compressed.
+func decompress(p []byte) ([]byte, error) {
+	if len(p) < 2 || p[0] != compressionMarker {
+		return p, nil
+	}
+
+	data := p[2:]
+	switch codec := Codec(p[1]); codec {
+	case CodecNone:
+		return data, nil
+	case CodecGzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	case CodecSnappy:
+		return s2.Decode(nil, data)
+	case CodecZstd:
+		_, dec, err := zstdCodec()
+		if err != nil {
+			return nil, err
+		}
+		return dec.DecodeAll(data, nil)
+	default:
+		return nil, fmt.Errorf("unknown compression codec: %d", codec)
+	}
+}
+
+func recordCompression(codec Codec, raw, compressed int) {
+	_ = stats.RecordWithTags(
+		context.Background(),
+		[]tag.Mutator{tag.Upsert(codecKey, codec.String())},
+		compressionRatio.M(float64(raw)/float64(compressed)),
+	)
+}
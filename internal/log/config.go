@@ -5,5 +5,15 @@ type Config struct {
 		MaxStoreBytes uint64
 		MaxIndexBytes uint64
 		InitialOffset uint64
+		// Compression is the codec applied to records appended to new
+		// segments. Segments can hold records written with any codec.
+		Compression Codec
+		// Encryption, if set, encrypts the records of new segments with the
+		// provider's current key.
+		Encryption KeyProvider
+		// IndexInterval is the number of store bytes written between index
+		// entries. Zero indexes every record; a larger interval keeps the
+		// index small at the cost of scanning the store on reads.
+		IndexInterval uint64
 	}
 }
@@ -0,0 +1,164 @@
+package log
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrNoKeyProvider is returned when opening an encrypted store without a key
+// provider configured.
+var ErrNoKeyProvider = errors.New("store is encrypted but no key provider is configured")
+
+// KeyProvider supplies the AES keys used to encrypt records at rest. Each key
+// has an id that's written to the header of the stores it encrypted, so keys
+// can be rotated while segments written with older keys remain readable.
+type KeyProvider interface {
+	// CurrentKey returns the key new segments are encrypted with.
+	CurrentKey() (id uint32, key []byte, err error)
+	// Key returns the key with the given id.
+	Key(id uint32) ([]byte, error)
+}
+
+// FileKeyProvider reads keys from a file with one "<id>:<base64 key>" entry
+// per line. The key with the highest id is used for new segments.
+type FileKeyProvider struct {
+	path string
+
+	mu      sync.RWMutex
+	keys    map[uint32][]byte
+	current uint32
+}
+
+func NewFileKeyProvider(path string) (*FileKeyProvider, error) {
+	p := &FileKeyProvider{path: path}
+	return p, p.Reload()
+}
+
+// Reload reads the key file again, which allows adding a new key without
+// restarting.
+func (p *FileKeyProvider) Reload() error {
+	f, err := os.Open(p.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	keys := make(map[uint32][]byte)
+	var current uint32
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(text, ":", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("%s:%d: expected <id>:<key>", p.path, line)
+		}
+
+		id, err := strconv.ParseUint(strings.TrimSpace(parts[0]), 10, 32)
+		if err != nil {
+			return fmt.Errorf("%s:%d: invalid key id: %w", p.path, line, err)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return fmt.Errorf("%s:%d: invalid key: %w", p.path, line, err)
+		}
+
+		if _, err := aes.NewCipher(key); err != nil {
+			return fmt.Errorf("%s:%d: %w", p.path, line, err)
+		}
+
+		keys[uint32(id)] = key
+		if uint32(id) >= current {
+			current = uint32(id)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	if len(keys) == 0 {
+		return fmt.Errorf("no keys found in %s", p.path)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.keys = keys
+	p.current = current
+
+	return nil
+}
+
+func (p *FileKeyProvider) CurrentKey() (uint32, []byte, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.current, p.keys[p.current], nil
+}
+
+func (p *FileKeyProvider) Key(id uint32) ([]byte, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	key, ok := p.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown encryption key id: %d", id)
+	}
+
+	return key, nil
+}
+
+var (
+	// encryptionMagic starts the header of encrypted stores. A plain store
+	// starts with a record length, which can never be this large.
+	encryptionMagic = []byte("DLGE")
+	headerWidth     = uint64(len(encryptionMagic)) + 4
+)
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// sealRecord encrypts p using the record's position in the store as
+// additional data, so records can't be moved around within the file.
+func sealRecord(aead cipher.AEAD, pos uint64, p []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(p)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	ad := make([]byte, 8)
+	enc.PutUint64(ad, pos)
+
+	return aead.Seal(nonce, nonce, p, ad), nil
+}
+
+func openRecord(aead cipher.AEAD, pos uint64, p []byte) ([]byte, error) {
+	if len(p) < aead.NonceSize() {
+		return nil, errors.New("encrypted record is too short")
+	}
+
+	ad := make([]byte, 8)
+	enc.PutUint64(ad, pos)
+
+	nonce, ciphertext := p[:aead.NonceSize()], p[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, ad)
+}
@@ -82,6 +82,31 @@ func (i *index) Read(in int64) (out uint32, pos uint64, err error) {
 	return out, pos, nil
 }
 
+// Search returns the last entry whose offset is less than or equal to in.
+func (i *index) Search(in uint32) (out uint32, pos uint64, err error) {
+	n := i.size / entryWidth
+	if n == 0 {
+		return 0, 0, io.EOF
+	}
+
+	// find the first entry with an offset greater than in.
+	lo, hi := uint64(0), n
+	for lo < hi {
+		mid := (lo + hi) / 2
+		if enc.Uint32(i.mmap[mid*entryWidth:mid*entryWidth+offWidth]) <= in {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+
+	if lo == 0 {
+		return 0, 0, io.EOF
+	}
+
+	return i.Read(int64(lo - 1))
+}
+
 func (i *index) Write(off uint32, pos uint64) error {
 	if uint64(len(i.mmap)) < i.size+entryWidth {
 		return io.EOF
@@ -80,3 +80,40 @@ func TestIndex(t *testing.T) {
 		t.Error("positions not equal")
 	}
 }
+
+func TestIndexSearch(t *testing.T) {
+	f, err := ioutil.TempFile(os.TempDir(), "index_search_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = 1024
+	idx, err := newIndex(f, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	if _, _, err = idx.Search(0); err != io.EOF {
+		t.Errorf("got err: %v, want: %v", err, io.EOF)
+	}
+
+	for _, off := range []uint32{0, 4, 9} {
+		if err = idx.Write(off, uint64(off)*10); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for in, want := range map[uint32]uint32{0: 0, 3: 0, 4: 4, 8: 4, 9: 9, 100: 9} {
+		out, pos, err := idx.Search(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if out != want || pos != uint64(want)*10 {
+			t.Errorf("search %d: got (%d, %d), want: (%d, %d)", in, out, pos, want, want*10)
+		}
+	}
+}
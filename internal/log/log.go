@@ -9,6 +9,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	api "github.com/nireo/dilog/api/v1"
 )
@@ -46,8 +47,17 @@ func (l *Log) setup() error {
 
 	var baseOffsets []uint64
 	for _, file := range files {
+		// every segment has a store file, anything else in the directory
+		// is either an index or unrelated to the log.
+		if path.Ext(file.Name()) != ".store" {
+			continue
+		}
+
 		offStr := strings.TrimSuffix(file.Name(), path.Ext(file.Name()))
-		off, _ := strconv.ParseUint(offStr, 10, 0)
+		off, err := strconv.ParseUint(offStr, 10, 0)
+		if err != nil {
+			continue
+		}
 		baseOffsets = append(baseOffsets, off)
 	}
 
@@ -59,9 +69,6 @@ func (l *Log) setup() error {
 		if err := l.newSegment(baseOffsets[i]); err != nil {
 			return err
 		}
-
-		// skip index file
-		i++
 	}
 
 	if l.segments == nil {
@@ -74,6 +81,8 @@ func (l *Log) setup() error {
 }
 
 func (l *Log) Append(record *api.Record) (uint64, error) {
+	start := time.Now()
+
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
@@ -81,6 +90,7 @@ func (l *Log) Append(record *api.Record) (uint64, error) {
 	if err != nil {
 		return 0, err
 	}
+	l.recordLatency(appendLatency, start)
 
 	if l.activeSegment.IsMaxed() {
 		err = l.newSegment(off + 1)
@@ -90,6 +100,8 @@ func (l *Log) Append(record *api.Record) (uint64, error) {
 }
 
 func (l *Log) Read(off uint64) (*api.Record, error) {
+	start := time.Now()
+
 	l.mu.RLock()
 	defer l.mu.RUnlock()
 	var s *segment
@@ -104,7 +116,15 @@ func (l *Log) Read(off uint64) (*api.Record, error) {
 		return nil, api.ErrOffsetOutOfRange{Offset: off}
 	}
 
-	return s.Read(off)
+	record, err := s.Read(off)
+	if err != nil {
+		return nil, err
+	}
+	// reads past the end are how consumers wait for new records, so only
+	// reads that found one are timed.
+	l.recordLatency(readLatency, start)
+
+	return record, nil
 }
 
 func (l *Log) Close() error {
@@ -133,6 +153,12 @@ func (l *Log) Reset() error {
 		return err
 	}
 
+	l.segments = nil
+	l.activeSegment = nil
+	if err := os.MkdirAll(l.Dir, 0755); err != nil {
+		return err
+	}
+
 	return l.setup()
 }
 
@@ -155,6 +181,15 @@ func (l *Log) HighestOffset() (uint64, error) {
 	return off - 1, nil
 }
 
+// NextOffset returns the offset the next appended record will get. Unlike
+// HighestOffset it tells an empty log apart from one with a single record.
+func (l *Log) NextOffset() (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.segments[len(l.segments)-1].nextOffset, nil
+}
+
 func (l *Log) Truncate(lowest uint64) error {
 	l.mu.Lock()
 	defer l.mu.Unlock()
@@ -200,6 +235,12 @@ func (o *originReader) Read(p []byte) (int, error) {
 }
 
 func (l *Log) newSegment(off uint64) error {
+	if l.activeSegment != nil {
+		if err := l.activeSegment.seal(); err != nil {
+			return err
+		}
+	}
+
 	s, err := newSegment(l.Dir, off, l.Config)
 	if err != nil {
 		return err
@@ -19,6 +19,7 @@ func TestLog(t *testing.T) {
 		"init with existing segments":       testInitExisting,
 		"reader":                            testReader,
 		"truncaate":                         testTruncate,
+		"reset":                             testReset,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			dir, err := ioutil.TempDir("", "store-test")
@@ -186,3 +187,30 @@ func testTruncate(t *testing.T, log *Log) {
 		t.Error("could read value after truncating")
 	}
 }
+
+func testReset(t *testing.T, log *Log) {
+	append := &api.Record{
+		Value: []byte("hello world"),
+	}
+
+	// fill enough segments for the older ones to be sealed.
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(append)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	if err := log.Reset(); err != nil {
+		t.Fatal(err)
+	}
+
+	off, err := log.Append(append)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if uint64(0) != off {
+		t.Errorf("got offset: %d, want: 0", off)
+	}
+}
@@ -0,0 +1,118 @@
+package log
+
+import (
+	"context"
+	"path/filepath"
+	"time"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+var (
+	codecKey = tag.MustNewKey("codec")
+	peerKey  = tag.MustNewKey("peer")
+	logKey   = tag.MustNewKey("log")
+
+	compressionRatio = stats.Float64(
+		"dilog/log/compression_ratio",
+		"Ratio of uncompressed to stored record size",
+		stats.UnitDimensionless,
+	)
+	appendLatency = stats.Float64(
+		"dilog/log/append_latency",
+		"Time taken to append a record",
+		stats.UnitMilliseconds,
+	)
+	readLatency = stats.Float64(
+		"dilog/log/read_latency",
+		"Time taken to read a record",
+		stats.UnitMilliseconds,
+	)
+	replicationLag = stats.Int64(
+		"dilog/replicator/lag",
+		"Number of records a peer's log is ahead of what was replicated",
+		stats.UnitDimensionless,
+	)
+)
+
+// Views contains the OpenCensus views for the log's internals. They need to
+// be registered with view.Register before any data is exported.
+var Views = []*view.View{
+	{
+		Name:        "dilog/log/compression_ratio",
+		Description: "Distribution of record compression ratios by codec",
+		Measure:     compressionRatio,
+		TagKeys:     []tag.Key{codecKey},
+		Aggregation: view.Distribution(1, 1.5, 2, 3, 5, 10, 20),
+	},
+	{
+		Name:        "dilog/log/append_latency",
+		Description: "Distribution of append latencies by log",
+		Measure:     appendLatency,
+		TagKeys:     []tag.Key{logKey},
+		Aggregation: latencyDistribution,
+	},
+	{
+		Name:        "dilog/log/read_latency",
+		Description: "Distribution of read latencies by log",
+		Measure:     readLatency,
+		TagKeys:     []tag.Key{logKey},
+		Aggregation: latencyDistribution,
+	},
+	{
+		Name:        "dilog/replicator/lag",
+		Description: "Last observed replication lag by peer",
+		Measure:     replicationLag,
+		TagKeys:     []tag.Key{peerKey},
+		Aggregation: view.LastValue(),
+	},
+}
+
+var latencyDistribution = view.Distribution(
+	0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 25, 50, 100, 250, 500, 1000,
+)
+
+// Stats is a snapshot of a log's size.
+type Stats struct {
+	Segments int
+	// Bytes is the size of the segments' stores and indexes on disk.
+	Bytes uint64
+	// StoreFill and IndexFill are how full the active segment's store and
+	// index are, from 0 to 1. The segment is sealed once either is full.
+	StoreFill float64
+	IndexFill float64
+}
+
+// Stats returns the log's current size.
+func (l *Log) Stats() Stats {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	stats := Stats{Segments: len(l.segments)}
+	for _, s := range l.segments {
+		stats.Bytes += s.store.size + s.index.size
+	}
+
+	if s := l.activeSegment; s != nil {
+		stats.StoreFill = float64(s.store.size) / float64(l.Config.Segment.MaxStoreBytes)
+		stats.IndexFill = float64(s.index.size) / float64(l.Config.Segment.MaxIndexBytes)
+	}
+
+	return stats
+}
+
+// Name identifies the log in metrics, it's the base of its directory.
+func (l *Log) Name() string {
+	return filepath.Base(l.Dir)
+}
+
+// recordLatency records the time since start with the log's name.
+func (l *Log) recordLatency(m *stats.Float64Measure, start time.Time) {
+	_ = stats.RecordWithTags(
+		context.Background(),
+		[]tag.Mutator{tag.Upsert(logKey, l.Name())},
+		m.M(float64(time.Since(start))/float64(time.Millisecond)),
+	)
+}
@@ -0,0 +1,291 @@
+package log
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/nireo/dilog/internal/placement"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+
+	api "github.com/nireo/dilog/api/v1"
+)
+
+const (
+	RepairCopying = "copying"
+	RepairBackoff = "backoff"
+	RepairDone    = "done"
+	RepairFailed  = "failed"
+)
+
+var errNoRepairSource = errors.New("no alive node holds a replica of the log")
+
+// repairTask copies a failed member's log onto the local node after the log
+// was placed here, from the alive nodes that held it before the failure.
+type repairTask struct {
+	log     string
+	sources []repairSource
+	cancel  chan struct{}
+
+	// the rest is guarded by the replicator's statusMu.
+	source   string
+	state    string
+	lastErr  string
+	copied   uint64
+	position uint64
+	target   uint64
+}
+
+type repairSource struct {
+	name string
+	addr string
+}
+
+// Fail marks the member as failed and stops replicating it. Its log gets
+// placed on the alive nodes instead, and if that moves it onto the local
+// node, it's copied from the alive nodes that held it.
+func (r *Replicator) Fail(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.init()
+
+	if _, ok := r.members[name]; !ok {
+		return nil
+	}
+
+	r.failed[name] = true
+	r.stop(name)
+	r.rebalance()
+
+	return nil
+}
+
+// planRepair starts copying the failed member's log if it's now placed on
+// the local node but wasn't while the member was alive. r.mu must be held.
+func (r *Replicator) planRepair(name string, nodes []placement.Node) {
+	if r.ReplicationFactor <= 0 {
+		// every node already holds every log.
+		return
+	}
+
+	if !placement.Place(name, nodes, r.ReplicationFactor).Has(r.NodeName) {
+		r.cancelRepair(name)
+		return
+	}
+
+	if task, ok := r.repairs[name]; ok {
+		r.statusMu.Lock()
+		state := task.state
+		r.statusMu.Unlock()
+		if state != RepairFailed {
+			return
+		}
+	}
+
+	before := make([]placement.Node, len(nodes))
+	copy(before, nodes)
+	for i := range before {
+		if before[i].Name == name {
+			before[i].Alive = true
+		}
+	}
+
+	held := placement.Place(name, before, r.ReplicationFactor)
+	if held.Has(r.NodeName) {
+		return
+	}
+
+	task := &repairTask{
+		log:    name,
+		cancel: make(chan struct{}),
+		state:  RepairCopying,
+	}
+	for _, n := range held.Replicas {
+		if n.Name == name {
+			continue
+		}
+		task.sources = append(task.sources, repairSource{
+			name: n.Name,
+			addr: r.members[n.Name].RPCAddr(),
+		})
+	}
+
+	r.statusMu.Lock()
+	r.repairs[name] = task
+	r.statusMu.Unlock()
+
+	go r.repair(task)
+}
+
+// cancelRepair stops copying the member's log. r.mu must be held.
+func (r *Replicator) cancelRepair(name string) {
+	task, ok := r.repairs[name]
+	if !ok {
+		return
+	}
+
+	r.statusMu.Lock()
+	delete(r.repairs, name)
+	r.statusMu.Unlock()
+
+	close(task.cancel)
+}
+
+// repair copies the task's log, trying each source in turn with exponential
+// backoff between attempts, until it's done or cancelled.
+func (r *Replicator) repair(task *repairTask) {
+	defer r.syncState(true)
+
+	if len(task.sources) == 0 {
+		r.setRepairState(task, RepairFailed, errNoRepairSource)
+		return
+	}
+
+	r.logger.Info("repairing log of failed node", zap.String("log", task.log))
+
+	backoff := minReplicateBackoff
+	for attempt := 0; ; attempt++ {
+		source := task.sources[attempt%len(task.sources)]
+		err := r.repairFrom(task, source)
+		if err == nil {
+			return
+		}
+
+		r.logError(err, "failed to repair", source.addr)
+		r.setRepairState(task, RepairBackoff, err)
+
+		select {
+		case <-r.close:
+			return
+		case <-task.cancel:
+			return
+		case <-time.After(backoff):
+		}
+
+		if backoff *= 2; backoff > maxReplicateBackoff {
+			backoff = maxReplicateBackoff
+		}
+	}
+}
+
+// repairFrom copies the task's log records out of the source's log. The
+// failed node won't write more records, so the copy is done once the source's
+// log has been read up to where it ended when copying started. It returns nil
+// when done or cancelled.
+func (r *Replicator) repairFrom(task *repairTask, source repairSource) error {
+	r.statusMu.Lock()
+	if task.source != source.name {
+		task.source = source.name
+		task.position = 0
+	}
+	task.state = RepairCopying
+	position := task.position
+	r.statusMu.Unlock()
+
+	cc, err := grpc.Dial(source.addr, r.DialOptions...)
+	if err != nil {
+		return err
+	}
+	defer cc.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := api.NewLogClient(cc)
+	offsets, err := client.GetOffsets(ctx, &api.GetOffsetsRequest{})
+	if err != nil {
+		return err
+	}
+
+	// records the source truncated can't be copied anymore.
+	if position < offsets.LowestOffset {
+		position = offsets.LowestOffset
+	}
+
+	r.statusMu.Lock()
+	task.target = offsets.NextOffset
+	task.position = position
+	r.statusMu.Unlock()
+
+	if position >= offsets.NextOffset {
+		r.setRepairState(task, RepairDone, nil)
+		return nil
+	}
+
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: position})
+	if err != nil {
+		return err
+	}
+
+	records, errs := receive(ctx, stream)
+	for {
+		select {
+		case <-r.close:
+			return nil
+		case <-task.cancel:
+			return nil
+		case err := <-errs:
+			return err
+		case record := <-records:
+			applied, err := r.apply(ctx, source.name, task.log, record)
+			if err != nil {
+				return err
+			}
+
+			r.statusMu.Lock()
+			if applied {
+				task.copied++
+			}
+			task.position = record.Offset + 1
+			done := task.position >= task.target
+			r.statusMu.Unlock()
+
+			if done {
+				r.setRepairState(task, RepairDone, nil)
+				r.logger.Info("repaired log of failed node", zap.String("log", task.log))
+				return nil
+			}
+		}
+	}
+}
+
+func (r *Replicator) setRepairState(task *repairTask, state string, err error) {
+	r.statusMu.Lock()
+	defer r.statusMu.Unlock()
+
+	task.state = state
+	if err != nil {
+		task.lastErr = err.Error()
+	}
+}
+
+// Repairs returns the repairs of failed nodes' logs, sorted by log.
+func (r *Replicator) Repairs() []*api.Repair {
+	r.mu.Lock()
+	r.init()
+	r.mu.Unlock()
+
+	r.statusMu.Lock()
+	defer r.statusMu.Unlock()
+
+	repairs := make([]*api.Repair, 0, len(r.repairs))
+	for _, task := range r.repairs {
+		repairs = append(repairs, &api.Repair{
+			Log:       task.log,
+			Source:    task.source,
+			State:     task.state,
+			LastError: task.lastErr,
+			Copied:    task.copied,
+			Position:  task.position,
+			Target:    task.target,
+		})
+	}
+
+	sort.Slice(repairs, func(i, j int) bool {
+		return repairs[i].Log < repairs[j].Log
+	})
+
+	return repairs
+}
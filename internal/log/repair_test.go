@@ -0,0 +1,224 @@
+package log
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nireo/dilog/internal/placement"
+	"google.golang.org/grpc"
+
+	api "github.com/nireo/dilog/api/v1"
+)
+
+// testServer serves just enough of a log for replicating it.
+type testServer struct {
+	api.UnimplementedLogServer
+	log *Log
+}
+
+func (s *testServer) Produce(ctx context.Context, req *api.ProduceRequest) (*api.ProduceResponse, error) {
+	off, err := s.log.Append(req.Record)
+	if err != nil {
+		return nil, err
+	}
+	return &api.ProduceResponse{Offset: off}, nil
+}
+
+func (s *testServer) ConsumeStream(req *api.ConsumeRequest, stream api.Log_ConsumeStreamServer) error {
+	for off := req.Offset; ; {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		default:
+		}
+
+		record, err := s.log.Read(off)
+		if err != nil {
+			lowest, err := s.log.LowestOffset()
+			if err != nil {
+				return err
+			}
+			if off < lowest {
+				return api.ErrOffsetTruncated{Offset: off, LowestOffset: lowest}
+			}
+
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+
+		if err := stream.Send(&api.ConsumeResponse{Record: record}); err != nil {
+			return err
+		}
+		off++
+	}
+}
+
+func (s *testServer) GetOffsets(ctx context.Context, req *api.GetOffsetsRequest) (*api.GetOffsetsResponse, error) {
+	lowest, err := s.log.LowestOffset()
+	if err != nil {
+		return nil, err
+	}
+	next, err := s.log.NextOffset()
+	if err != nil {
+		return nil, err
+	}
+	return &api.GetOffsetsResponse{LowestOffset: lowest, NextOffset: next}, nil
+}
+
+func setupTestServer(t *testing.T) (*Log, string, func()) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "repair-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log, err := NewLog(dir, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := grpc.NewServer()
+	api.RegisterLogServer(srv, &testServer{log: log})
+	go srv.Serve(ln)
+
+	return log, ln.Addr().String(), func() {
+		srv.Stop()
+		log.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestReplicatorRepair(t *testing.T) {
+	const factor = 2
+
+	// pick a local node that only gets x's log once x fails.
+	var local string
+	for i := 0; local == ""; i++ {
+		if i == 100 {
+			t.Fatal("no suitable local node name")
+		}
+
+		name := fmt.Sprintf("local-%d", i)
+		nodes := []placement.Node{
+			{Name: "x", Alive: true},
+			{Name: "a", Alive: true},
+			{Name: "b", Alive: true},
+			{Name: name, Alive: true},
+		}
+		if placement.Place("x", nodes, factor).Has(name) {
+			continue
+		}
+
+		nodes[0].Alive = false
+		if placement.Place("x", nodes, factor).Has(name) {
+			local = name
+		}
+	}
+
+	localLog, localAddr, teardown := setupTestServer(t)
+	defer teardown()
+
+	// both a and b hold x's records, only the one x's log was placed on
+	// gets copied from.
+	addrs := make(map[string]string)
+	for _, name := range []string{"a", "b"} {
+		log, addr, teardown := setupTestServer(t)
+		defer teardown()
+		addrs[name] = addr
+
+		for i := 0; i < 3; i++ {
+			_, err := log.Append(&api.Record{
+				Value:        []byte(fmt.Sprintf("record %d", i)),
+				Origin:       "x",
+				OriginOffset: uint64(i),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	cc, err := grpc.Dial(localAddr, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	r := &Replicator{
+		DialOptions:       []grpc.DialOption{grpc.WithInsecure()},
+		LocalServer:       api.NewLogClient(cc),
+		NodeName:          local,
+		ReplicationFactor: factor,
+	}
+	defer r.Close()
+
+	// x is unreachable, which doesn't matter while it isn't placed here.
+	for name, addr := range map[string]string{"x": "127.0.0.1:1", "a": addrs["a"], "b": addrs["b"]} {
+		if err := r.Join(name, addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(r.Repairs()) != 0 {
+		t.Fatal("repairing before any node failed")
+	}
+
+	if err := r.Fail("x"); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		repairs := r.Repairs()
+		if len(repairs) == 1 && repairs[0].State == RepairDone {
+			if repairs[0].Log != "x" || repairs[0].Copied != 3 {
+				t.Fatalf("got repair: %v", repairs[0])
+			}
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("repair didn't finish: %v", repairs)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	var copied int
+	next, err := localLog.NextOffset()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for off := uint64(0); off < next; off++ {
+		record, err := localLog.Read(off)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if record.Origin == "x" {
+			copied++
+		}
+	}
+
+	if copied != 3 {
+		t.Fatalf("got %d of x's records, want: 3", copied)
+	}
+
+	// once x is back, its log isn't placed here anymore.
+	if err := r.Join("x", "127.0.0.1:1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(r.Repairs()) != 0 {
+		t.Fatal("repair wasn't cancelled after the node rejoined")
+	}
+}
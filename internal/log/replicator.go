@@ -2,26 +2,131 @@ package log
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
 	"sync"
+	"time"
 
+	"github.com/nireo/dilog/internal/discovery"
+	"github.com/nireo/dilog/internal/placement"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+	"go.opencensus.io/trace"
+	"go.opencensus.io/trace/propagation"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
 
 	api "github.com/nireo/dilog/api/v1"
 )
 
+const (
+	replicationStateFile = "replication.json"
+
+	// stateSyncInterval limits how often the replication offsets are
+	// written to disk while records are flowing.
+	stateSyncInterval = time.Second
+
+	minReplicateBackoff = 100 * time.Millisecond
+	maxReplicateBackoff = 10 * time.Second
+
+	// offsetsPollInterval is how often peers are asked for their offsets to
+	// compute the replication lag.
+	offsetsPollInterval = time.Second
+
+	PeerConnecting  = "connecting"
+	PeerReplicating = "replicating"
+	PeerBackoff     = "backoff"
+)
+
+// errPeerLogBehind is returned when a peer's log ends below the offset it was
+// replicated up to, after it was wiped or reset.
+var errPeerLogBehind = errors.New("peer's log is behind the replicated offset")
+
 type Replicator struct {
 	DialOptions []grpc.DialOption
 	LocalServer api.LogClient
-	logger      *zap.Logger
+	// NodeName is the local node's name. Records that originated on it are
+	// never replicated back.
+	NodeName string
+	// DataDir is where the replicator persists how far it has replicated
+	// each peer's log, so it can resume from there after a restart. Nothing
+	// is persisted if it's empty.
+	DataDir string
+	// Log is the local log. The state is only saved once a second, so on
+	// startup the records appended since it was saved are read from the log
+	// to find the origin offsets already applied. Records applied just
+	// before a crash would be applied again without it.
+	Log *Log
+	// LagThreshold is the number of records a peer can be ahead of the
+	// local node before a warning is logged. Zero disables the warning.
+	LagThreshold uint64
+	// ReplicationFactor is the number of nodes each node's log is kept on.
+	// Only the peers whose logs are placed on the local node are replicated,
+	// and only their own records. Zero replicates every peer's log in full.
+	ReplicationFactor int
+	// Zone is the local node's zone, used to spread replicas across zones.
+	Zone   string
+	logger *zap.Logger
 
-	mu      sync.Mutex
+	mu sync.Mutex
+	// members are the other nodes in the cluster and servers the ones
+	// being replicated. Failed members stay until they rejoin or leave.
+	members map[string]discovery.Member
+	failed  map[string]bool
 	servers map[string]chan struct{}
+	repairs map[string]*repairTask
+	paused  bool
 	closed  bool
 	close   chan struct{}
+
+	// applyMu serializes applying records, since the same record can arrive
+	// from several peers at once.
+	applyMu  sync.Mutex
+	stateMu  sync.Mutex
+	state    *replicationState
+	lastSync time.Time
+
+	statusMu sync.Mutex
+	peers    map[string]*peerStatus
 }
 
-func (r *Replicator) Join(name, addr string) error {
+// peerStatus tracks how replication from a peer is going.
+type peerStatus struct {
+	addr       string
+	zone       string
+	state      string
+	lastErr    string
+	remoteNext uint64
+	lagging    bool
+}
+
+// replicationState is the replicator's on-disk state.
+type replicationState struct {
+	// Peers maps a peer's name to the next offset to consume from its log.
+	Peers map[string]uint64 `json:"peers"`
+	// Origins maps a node's name to the offset in its log following the
+	// last record from it that was applied locally.
+	Origins map[string]uint64 `json:"origins"`
+	// Applied is the local log's next offset when the state was saved.
+	// Origins covers every record below it.
+	Applied uint64 `json:"applied"`
+}
+
+func newReplicationState() *replicationState {
+	return &replicationState{
+		Peers:   make(map[string]uint64),
+		Origins: make(map[string]uint64),
+	}
+}
+
+// JoinMember records the member and starts replicating its log if it's
+// placed on the local node.
+func (r *Replicator) JoinMember(member discovery.Member) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	r.init()
@@ -30,71 +135,447 @@ func (r *Replicator) Join(name, addr string) error {
 		return nil
 	}
 
-	if _, ok := r.servers[name]; ok {
-		return nil
-	}
-	r.servers[name] = make(chan struct{})
-	go r.replicate(addr, r.servers[name])
+	r.members[member.Name] = member
+	delete(r.failed, member.Name)
+	r.rebalance()
 	return nil
 }
 
-func (r *Replicator) replicate(addr string, leave chan struct{}) {
+func (r *Replicator) Join(name, addr string) error {
+	return r.JoinMember(discovery.Member{
+		Name: name,
+		Tags: map[string]string{discovery.TagRPCAddr: addr},
+	})
+}
+
+// rebalance starts replicating the members whose logs are placed on the
+// local node and stops replicating the rest. r.mu must be held.
+func (r *Replicator) rebalance() {
+	if r.closed || r.paused {
+		return
+	}
+
+	nodes := r.nodes()
+	for name, member := range r.members {
+		if r.failed[name] {
+			r.planRepair(name, nodes)
+			continue
+		}
+		r.cancelRepair(name)
+
+		assigned := r.ReplicationFactor <= 0 ||
+			placement.Place(name, nodes, r.ReplicationFactor).Has(r.NodeName)
+
+		_, running := r.servers[name]
+		switch {
+		case assigned && !running:
+			r.start(member)
+		case !assigned && running:
+			r.stop(name)
+		}
+	}
+}
+
+// nodes returns the local node and the members for placing logs. r.mu must
+// be held.
+func (r *Replicator) nodes() []placement.Node {
+	nodes := []placement.Node{{Name: r.NodeName, Zone: r.Zone, Alive: true}}
+	for name, member := range r.members {
+		nodes = append(nodes, placement.Node{
+			Name:  name,
+			Zone:  member.Zone(),
+			Alive: !r.failed[name],
+		})
+	}
+	return nodes
+}
+
+func (r *Replicator) start(member discovery.Member) {
+	leave := make(chan struct{})
+	r.servers[member.Name] = leave
+
+	r.statusMu.Lock()
+	r.peers[member.Name] = &peerStatus{
+		addr:  member.RPCAddr(),
+		zone:  member.Zone(),
+		state: PeerConnecting,
+	}
+	r.statusMu.Unlock()
+
+	go r.replicate(member.Name, member.RPCAddr(), leave)
+}
+
+func (r *Replicator) stop(name string) {
+	leave, ok := r.servers[name]
+	if !ok {
+		return
+	}
+	close(leave)
+	delete(r.servers, name)
+
+	r.statusMu.Lock()
+	delete(r.peers, name)
+	r.statusMu.Unlock()
+}
+
+// replicate copies the peer's log until it leaves or the replicator closes,
+// reconnecting with exponential backoff whenever the stream breaks.
+func (r *Replicator) replicate(name, addr string, leave chan struct{}) {
+	defer r.syncState(true)
+
+	backoff := minReplicateBackoff
+	for {
+		start := r.offset(name)
+		err := r.replicateStream(name, addr, leave)
+		if err == nil {
+			return
+		}
+
+		r.logError(err, "failed to replicate", addr)
+		r.setPeerState(name, PeerBackoff, err)
+		if r.offset(name) > start {
+			backoff = minReplicateBackoff
+		}
+
+		select {
+		case <-r.close:
+			return
+		case <-leave:
+			return
+		case <-time.After(backoff):
+		}
+
+		if backoff *= 2; backoff > maxReplicateBackoff {
+			backoff = maxReplicateBackoff
+		}
+	}
+}
+
+// replicateStream consumes the peer's log from the last replicated offset
+// onwards. It returns nil if the peer left or the replicator closed.
+func (r *Replicator) replicateStream(name, addr string, leave chan struct{}) error {
+	r.setPeerState(name, PeerConnecting, nil)
 	cc, err := grpc.Dial(addr, r.DialOptions...)
 	if err != nil {
-		r.logError(err, "failed to dial", addr)
-		return
+		return err
 	}
 	defer cc.Close()
 
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
 	client := api.NewLogClient(cc)
-	ctx := context.Background()
+	offsets, err := client.GetOffsets(ctx, &api.GetOffsetsRequest{})
+	if err != nil {
+		return err
+	}
+
+	// a peer whose log ends below the replicated offset lost it, so its new
+	// log is replicated from the start.
+	offset := r.offset(name)
+	if offset > offsets.NextOffset {
+		r.logger.Warn(
+			"peer's log is behind the replicated offset, replicating it again",
+			zap.String("name", name),
+			zap.String("addr", addr),
+			zap.Uint64("offset", offset),
+			zap.Uint64("next_offset", offsets.NextOffset),
+		)
+		r.resetPeer(name)
+		offset = 0
+	}
+
+	// the records the peer truncated before they were replicated are gone,
+	// so replication carries on from its lowest offset.
+	if offset < offsets.LowestOffset {
+		r.logger.Warn(
+			"peer truncated records that weren't replicated",
+			zap.String("name", name),
+			zap.String("addr", addr),
+			zap.Uint64("offset", offset),
+			zap.Uint64("lowest_offset", offsets.LowestOffset),
+		)
+		offset = offsets.LowestOffset
+		r.setOffset(name, offset)
+	}
+
 	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{
-		Offset: 0,
+		Offset: offset,
 	})
-
 	if err != nil {
-		r.logError(err, "failed to consume", addr)
-		return
+		return err
+	}
+
+	r.setPeerState(name, PeerReplicating, nil)
+	behind := make(chan error, 1)
+	go r.pollOffsets(ctx, name, client, behind)
+
+	// with a replication factor, only the peer's own records are applied:
+	// the records it replicated may be from origins that aren't placed
+	// locally, and those that are get replicated from their origins.
+	var want string
+	if r.ReplicationFactor > 0 {
+		want = name
+	}
+
+	records, errs := receive(ctx, stream)
+	for {
+		select {
+		case <-r.close:
+			return nil
+		case <-leave:
+			return nil
+		case err := <-errs:
+			return err
+		case err := <-behind:
+			return err
+		case record := <-records:
+			if _, err := r.apply(ctx, name, want, record); err != nil {
+				return err
+			}
+
+			r.setOffset(name, record.Offset+1)
+			r.syncState(false)
+		}
 	}
+}
 
+// receive reads records from the stream until it breaks or ctx is done.
+// Reading happens in its own goroutine so callers can stop waiting on it.
+func receive(ctx context.Context, stream api.Log_ConsumeStreamClient) (<-chan *api.Record, <-chan error) {
 	records := make(chan *api.Record)
+	errs := make(chan error, 1)
 	go func() {
 		for {
 			recv, err := stream.Recv()
 			if err != nil {
-				r.logError(err, "failed to receive", addr)
+				errs <- err
+				return
+			}
+
+			select {
+			case records <- recv.Record:
+			case <-ctx.Done():
 				return
 			}
-			records <- recv.Record
 		}
 	}()
 
+	return records, errs
+}
+
+// apply produces a record consumed from the peer's log to the local log,
+// unless it originated locally or was already applied through another peer.
+// Each node appends an origin's records in order, so a record is new exactly
+// when its origin offset is past the last one applied from that origin. If
+// want is set, records from other origins are skipped. It reports whether
+// the record was appended.
+func (r *Replicator) apply(ctx context.Context, peer, want string, record *api.Record) (bool, error) {
+	if record.Origin == "" || record.Origin == peer {
+		record.Origin = peer
+		record.OriginOffset = record.Offset
+	}
+
+	if record.Origin == r.NodeName {
+		return false, nil
+	}
+
+	if want != "" && record.Origin != want {
+		return false, nil
+	}
+
+	r.applyMu.Lock()
+	defer r.applyMu.Unlock()
+
+	r.stateMu.Lock()
+	next, ok := r.state.Origins[record.Origin]
+	r.stateMu.Unlock()
+	if ok && record.OriginOffset < next {
+		return false, nil
+	}
+
+	ctx, span := startApplySpan(ctx, peer, record)
+	defer span.End()
+
+	if _, err := r.LocalServer.Produce(ctx, &api.ProduceRequest{Record: record}); err != nil {
+		span.SetStatus(trace.Status{Code: int32(status.Code(err)), Message: err.Error()})
+		return false, err
+	}
+
+	r.stateMu.Lock()
+	r.state.Origins[record.Origin] = record.OriginOffset + 1
+	r.stateMu.Unlock()
+
+	return true, nil
+}
+
+// startApplySpan starts the span of appending a replicated record, linked to
+// the call that first produced it. Records whose first produce was traced
+// are always traced, the others are sampled as usual.
+func startApplySpan(ctx context.Context, peer string, record *api.Record) (context.Context, *trace.Span) {
+	parent, ok := propagation.FromBinary(record.TraceContext)
+
+	var opts []trace.StartOption
+	if ok && parent.IsSampled() {
+		opts = append(opts, trace.WithSampler(trace.AlwaysSample()))
+	}
+
+	ctx, span := trace.StartSpan(ctx, "log.Replicator.apply", opts...)
+	span.AddAttributes(
+		trace.StringAttribute("peer", peer),
+		trace.StringAttribute("origin", record.Origin),
+		trace.Int64Attribute("origin_offset", int64(record.OriginOffset)),
+	)
+	if ok {
+		span.AddLink(trace.Link{
+			TraceID: parent.TraceID,
+			SpanID:  parent.SpanID,
+			Type:    trace.LinkTypeParent,
+		})
+	}
+
+	return ctx, span
+}
+
+// pollOffsets periodically fetches the peer's offsets until ctx is done, so
+// the lag can be tracked while there's nothing to replicate. If the peer's log
+// falls behind the replicated offset, errPeerLogBehind is sent on behind and
+// polling stops.
+func (r *Replicator) pollOffsets(ctx context.Context, name string, client api.LogClient, behind chan<- error) {
+	ticker := time.NewTicker(offsetsPollInterval)
+	defer ticker.Stop()
+
 	for {
-		select {
-		case <-r.close:
+		// the records below the offset were all in the peer's log before
+		// asking it, so its next offset can only be lower if it lost them.
+		replicated := r.offset(name)
+		res, err := client.GetOffsets(ctx, &api.GetOffsetsRequest{})
+		if err == nil && res.NextOffset < replicated {
+			behind <- errPeerLogBehind
 			return
-		case <-leave:
+		}
+
+		if err == nil {
+			r.updateLag(name, res.NextOffset)
+		} else if ctx.Err() == nil {
+			r.logger.Debug("failed to get offsets", zap.String("name", name), zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
 			return
-		case record := <-records:
-			_, err := r.LocalServer.Produce(ctx, &api.ProduceRequest{Record: record})
-			if err != nil {
-				r.logError(err, "failed to produce", addr)
-				return
-			}
+		case <-ticker.C:
 		}
 	}
 }
 
+func (r *Replicator) updateLag(name string, remoteNext uint64) {
+	behind := lag(remoteNext, r.offset(name))
+
+	r.statusMu.Lock()
+	p, ok := r.peers[name]
+	if !ok {
+		r.statusMu.Unlock()
+		return
+	}
+	p.remoteNext = remoteNext
+	lagging := r.LagThreshold > 0 && behind > r.LagThreshold
+	changed := lagging != p.lagging
+	p.lagging = lagging
+	addr := p.addr
+	r.statusMu.Unlock()
+
+	_ = stats.RecordWithTags(
+		context.Background(),
+		[]tag.Mutator{tag.Upsert(peerKey, name)},
+		replicationLag.M(int64(behind)),
+	)
+
+	if !changed {
+		return
+	}
+
+	if lagging {
+		r.logger.Warn(
+			"replication lag exceeds threshold",
+			zap.String("name", name),
+			zap.String("addr", addr),
+			zap.Uint64("lag", behind),
+			zap.Uint64("threshold", r.LagThreshold),
+		)
+	} else {
+		r.logger.Info(
+			"replication caught up",
+			zap.String("name", name),
+			zap.String("addr", addr),
+			zap.Uint64("lag", behind),
+		)
+	}
+}
+
+func lag(remoteNext, replicated uint64) uint64 {
+	if remoteNext <= replicated {
+		return 0
+	}
+	return remoteNext - replicated
+}
+
+func (r *Replicator) setPeerState(name, state string, err error) {
+	r.statusMu.Lock()
+	defer r.statusMu.Unlock()
+
+	p, ok := r.peers[name]
+	if !ok {
+		return
+	}
+
+	p.state = state
+	if err != nil {
+		p.lastErr = err.Error()
+	}
+}
+
+// Status returns the replication status of every peer, sorted by name.
+func (r *Replicator) Status() []*api.PeerReplicationStatus {
+	r.mu.Lock()
+	r.init()
+	r.mu.Unlock()
+
+	r.statusMu.Lock()
+	defer r.statusMu.Unlock()
+
+	status := make([]*api.PeerReplicationStatus, 0, len(r.peers))
+	for name, p := range r.peers {
+		replicated := r.offset(name)
+		status = append(status, &api.PeerReplicationStatus{
+			Name:             name,
+			RpcAddr:          p.addr,
+			Zone:             p.zone,
+			State:            p.state,
+			LastError:        p.lastErr,
+			RemoteNextOffset: p.remoteNext,
+			ReplicatedOffset: replicated,
+			Lag:              lag(p.remoteNext, replicated),
+		})
+	}
+
+	sort.Slice(status, func(i, j int) bool {
+		return status[i].Name < status[j].Name
+	})
+
+	return status
+}
+
 func (r *Replicator) Leave(name string) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	r.init()
 
-	if _, ok := r.servers[name]; !ok {
-		return nil
-	}
-	close(r.servers[name])
-	delete(r.servers, name)
+	delete(r.members, name)
+	delete(r.failed, name)
+	r.stop(name)
+	r.cancelRepair(name)
+	r.rebalance()
 
 	return nil
 }
@@ -108,9 +589,61 @@ func (r *Replicator) init() {
 		r.servers = make(map[string]chan struct{})
 	}
 
+	if r.members == nil {
+		r.members = make(map[string]discovery.Member)
+	}
+
+	if r.failed == nil {
+		r.failed = make(map[string]bool)
+	}
+
+	if r.repairs == nil {
+		r.repairs = make(map[string]*repairTask)
+	}
+
 	if r.close == nil {
 		r.close = make(chan struct{})
 	}
+
+	r.statusMu.Lock()
+	if r.peers == nil {
+		r.peers = make(map[string]*peerStatus)
+	}
+	r.statusMu.Unlock()
+
+	r.stateMu.Lock()
+	defer r.stateMu.Unlock()
+	if r.state == nil {
+		r.state = r.loadState()
+		r.recoverOrigins()
+	}
+}
+
+// Pause stops replicating and repairing until Resume is called. Members
+// keep being tracked in the meantime.
+func (r *Replicator) Pause() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.init()
+
+	r.paused = true
+	for name := range r.servers {
+		r.stop(name)
+	}
+	for name := range r.repairs {
+		r.cancelRepair(name)
+	}
+}
+
+// Resume starts replicating the members placed on the local node again,
+// from where replication was paused.
+func (r *Replicator) Resume() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.init()
+
+	r.paused = false
+	r.rebalance()
 }
 
 func (r *Replicator) Close() error {
@@ -127,6 +660,152 @@ func (r *Replicator) Close() error {
 	return nil
 }
 
+func (r *Replicator) offset(name string) uint64 {
+	r.stateMu.Lock()
+	defer r.stateMu.Unlock()
+
+	return r.state.Peers[name]
+}
+
+func (r *Replicator) setOffset(name string, off uint64) {
+	r.stateMu.Lock()
+	defer r.stateMu.Unlock()
+
+	r.state.Peers[name] = off
+}
+
+// resetPeer forgets how far the peer's log and the records originating on it
+// were replicated, so the records of its new log aren't skipped as applied.
+func (r *Replicator) resetPeer(name string) {
+	r.applyMu.Lock()
+	r.stateMu.Lock()
+	delete(r.state.Peers, name)
+	delete(r.state.Origins, name)
+	r.stateMu.Unlock()
+	r.applyMu.Unlock()
+
+	r.syncState(true)
+}
+
+func (r *Replicator) loadState() *replicationState {
+	state := newReplicationState()
+	if r.DataDir == "" {
+		return state
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(r.DataDir, replicationStateFile))
+	if os.IsNotExist(err) {
+		return state
+	}
+
+	if err == nil {
+		err = json.Unmarshal(b, state)
+	}
+
+	if err != nil {
+		r.logger.Error("failed to load replication state", zap.Error(err))
+		return newReplicationState()
+	}
+
+	if state.Peers == nil {
+		state.Peers = make(map[string]uint64)
+	}
+
+	if state.Origins == nil {
+		state.Origins = make(map[string]uint64)
+	}
+
+	return state
+}
+
+// recoverOrigins brings the origin offsets up to date with the records
+// appended to the local log since the state was saved. r.stateMu must be
+// held.
+func (r *Replicator) recoverOrigins() {
+	if r.Log == nil {
+		return
+	}
+
+	lowest, err := r.Log.LowestOffset()
+	if err != nil {
+		r.logger.Error("failed to recover replication state", zap.Error(err))
+		return
+	}
+
+	next, err := r.Log.NextOffset()
+	if err != nil {
+		r.logger.Error("failed to recover replication state", zap.Error(err))
+		return
+	}
+
+	off := r.state.Applied
+	if off < lowest {
+		off = lowest
+	}
+
+	for ; off < next; off++ {
+		record, err := r.Log.Read(off)
+		if err != nil {
+			r.logger.Error("failed to recover replication state", zap.Error(err))
+			return
+		}
+
+		if record.Origin == "" || record.Origin == r.NodeName {
+			continue
+		}
+
+		if record.OriginOffset+1 > r.state.Origins[record.Origin] {
+			r.state.Origins[record.Origin] = record.OriginOffset + 1
+		}
+	}
+	r.state.Applied = next
+}
+
+// syncState writes the replication state to the data dir. Unless force is
+// set, it's only written if stateSyncInterval has passed since the last time.
+func (r *Replicator) syncState(force bool) {
+	// holding applyMu keeps records from being applied between reading the
+	// log's next offset and encoding the origins that cover it.
+	r.applyMu.Lock()
+	defer r.applyMu.Unlock()
+
+	r.stateMu.Lock()
+	defer r.stateMu.Unlock()
+
+	if r.DataDir == "" || (!force && time.Since(r.lastSync) < stateSyncInterval) {
+		return
+	}
+
+	if r.Log != nil {
+		next, err := r.Log.NextOffset()
+		if err != nil {
+			r.logger.Error("failed to save replication state", zap.Error(err))
+			return
+		}
+		r.state.Applied = next
+	}
+
+	b, err := json.Marshal(r.state)
+	if err != nil {
+		r.logger.Error("failed to encode replication state", zap.Error(err))
+		return
+	}
+
+	// write to a temporary file and rename it so a crash mid-write can't
+	// corrupt the existing state.
+	name := filepath.Join(r.DataDir, replicationStateFile)
+	if err = ioutil.WriteFile(name+".tmp", b, 0644); err == nil {
+		err = os.Rename(name+".tmp", name)
+	}
+
+	if err != nil {
+		r.logger.Error("failed to save replication state", zap.Error(err))
+		return
+	}
+
+	r.lastSync = time.Now()
+}
+
 func (r *Replicator) logError(err error, msg, addr string) {
 	r.logger.Error(
 		msg,
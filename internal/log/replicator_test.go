@@ -0,0 +1,250 @@
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+
+	api "github.com/nireo/dilog/api/v1"
+)
+
+func setupReplicator(t *testing.T, dataDir string, local *Log, localAddr string) *Replicator {
+	t.Helper()
+
+	cc, err := grpc.Dial(localAddr, grpc.WithInsecure())
+	require.NoError(t, err)
+	t.Cleanup(func() { cc.Close() })
+
+	r := &Replicator{
+		DialOptions: []grpc.DialOption{grpc.WithInsecure()},
+		LocalServer: api.NewLogClient(cc),
+		NodeName:    "local",
+		DataDir:     dataDir,
+		Log:         local,
+	}
+	t.Cleanup(func() { r.Close() })
+
+	return r
+}
+
+func appendRecords(t *testing.T, log *Log, from, to int) {
+	t.Helper()
+
+	for i := from; i < to; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+}
+
+// requireReplicated waits for the peer's records to be replicated and checks
+// the local log holds each of them once.
+func requireReplicated(t *testing.T, r *Replicator, local *Log, peer string, n int) {
+	t.Helper()
+
+	require.Eventually(t, func() bool {
+		return r.offset(peer) == uint64(n)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	next, err := local.NextOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(n), next)
+
+	for off := uint64(0); off < next; off++ {
+		record, err := local.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, peer, record.Origin)
+		require.Equal(t, off, record.OriginOffset)
+	}
+}
+
+func TestReplicatorResume(t *testing.T) {
+	local, localAddr, teardown := setupTestServer(t)
+	defer teardown()
+
+	peer, peerAddr, teardown := setupTestServer(t)
+	defer teardown()
+	appendRecords(t, peer, 0, 3)
+
+	r := setupReplicator(t, "", local, localAddr)
+	require.NoError(t, r.Join("peer", peerAddr))
+	requireReplicated(t, r, local, "peer", 3)
+	require.NoError(t, r.Close())
+
+	// a node that crashed before saving its state starts over from the
+	// peer's first record, the records it already applied are found in the
+	// local log and skipped.
+	dataDir, err := ioutil.TempDir("", "replicator-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+
+	r = setupReplicator(t, dataDir, local, localAddr)
+	require.NoError(t, r.Join("peer", peerAddr))
+	appendRecords(t, peer, 3, 5)
+	requireReplicated(t, r, local, "peer", 5)
+	require.NoError(t, r.Close())
+
+	// a restart with the saved state resumes from where it left off.
+	require.Eventually(t, func() bool {
+		b, err := ioutil.ReadFile(filepath.Join(dataDir, replicationStateFile))
+		if err != nil {
+			return false
+		}
+
+		var state replicationState
+		return json.Unmarshal(b, &state) == nil && state.Peers["peer"] == 5
+	}, 5*time.Second, 10*time.Millisecond)
+
+	r = setupReplicator(t, dataDir, local, localAddr)
+	r.mu.Lock()
+	r.init()
+	r.mu.Unlock()
+	require.Equal(t, uint64(5), r.offset("peer"))
+	require.NoError(t, r.Join("peer", peerAddr))
+	appendRecords(t, peer, 5, 6)
+	requireReplicated(t, r, local, "peer", 6)
+}
+
+func TestReplicatorReconnect(t *testing.T) {
+	local, localAddr, teardown := setupTestServer(t)
+	defer teardown()
+
+	dir, err := ioutil.TempDir("", "replicator-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	peer, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	defer peer.Close()
+	appendRecords(t, peer, 0, 3)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	peerAddr := ln.Addr().String()
+
+	serve := func(ln net.Listener) *grpc.Server {
+		srv := grpc.NewServer()
+		api.RegisterLogServer(srv, &testServer{log: peer})
+		go srv.Serve(ln)
+		return srv
+	}
+	srv := serve(ln)
+
+	r := setupReplicator(t, "", local, localAddr)
+	require.NoError(t, r.Join("peer", peerAddr))
+	requireReplicated(t, r, local, "peer", 3)
+
+	// the peer going away without leaving the cluster puts it in backoff.
+	srv.Stop()
+	require.Eventually(t, func() bool {
+		status := r.Status()
+		return len(status) == 1 && status[0].State == PeerBackoff
+	}, 5*time.Second, 10*time.Millisecond)
+
+	appendRecords(t, peer, 3, 5)
+
+	ln, err = net.Listen("tcp", peerAddr)
+	require.NoError(t, err)
+	srv = serve(ln)
+	defer srv.Stop()
+
+	// once it's back, replication picks up where it broke off.
+	requireReplicated(t, r, local, "peer", 5)
+	require.Eventually(t, func() bool {
+		status := r.Status()
+		return len(status) == 1 && status[0].State == PeerReplicating
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestReplicatorTruncated(t *testing.T) {
+	local, localAddr, teardown := setupTestServer(t)
+	defer teardown()
+
+	peer, peerAddr, teardown := setupTestServer(t)
+	defer teardown()
+	appendRecords(t, peer, 0, 100)
+
+	// the peer truncated its first segment before anyone replicated it.
+	segments := peer.Segments()
+	require.Greater(t, len(segments), 2)
+	lowest := segments[1].BaseOffset
+	require.NoError(t, peer.Truncate(lowest-1))
+
+	r := setupReplicator(t, "", local, localAddr)
+	require.NoError(t, r.Join("peer", peerAddr))
+
+	// replication starts from the peer's lowest offset instead of waiting
+	// for the truncated records.
+	require.Eventually(t, func() bool {
+		return r.offset("peer") == 100
+	}, 5*time.Second, 10*time.Millisecond)
+
+	next, err := local.NextOffset()
+	require.NoError(t, err)
+	require.Equal(t, 100-lowest, next)
+
+	record, err := local.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, lowest, record.OriginOffset)
+}
+
+func TestReplicatorPeerReset(t *testing.T) {
+	local, localAddr, teardown := setupTestServer(t)
+	defer teardown()
+
+	dir, err := ioutil.TempDir("", "replicator-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	peer, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	defer peer.Close()
+	appendRecords(t, peer, 0, 5)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	peerAddr := ln.Addr().String()
+
+	serve := func(ln net.Listener) *grpc.Server {
+		srv := grpc.NewServer()
+		api.RegisterLogServer(srv, &testServer{log: peer})
+		go srv.Serve(ln)
+		return srv
+	}
+	srv := serve(ln)
+
+	r := setupReplicator(t, "", local, localAddr)
+	require.NoError(t, r.Join("peer", peerAddr))
+	requireReplicated(t, r, local, "peer", 5)
+
+	// the peer comes back with its log wiped and writes new records.
+	srv.Stop()
+	require.NoError(t, peer.Reset())
+	appendRecords(t, peer, 0, 2)
+
+	ln, err = net.Listen("tcp", peerAddr)
+	require.NoError(t, err)
+	srv = serve(ln)
+	defer srv.Stop()
+
+	// its new log is replicated from the start instead of waiting for it to
+	// reach the old offset, and its records aren't skipped as applied.
+	require.Eventually(t, func() bool {
+		next, err := local.NextOffset()
+		return err == nil && next == 7 && r.offset("peer") == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	for off := uint64(5); off < 7; off++ {
+		record, err := local.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, "peer", record.Origin)
+		require.Equal(t, off-5, record.OriginOffset)
+	}
+}
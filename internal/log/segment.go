@@ -1,7 +1,6 @@
 package log
 
 import (
-	"fmt"
 	"os"
 	"path/filepath"
 
@@ -14,6 +13,9 @@ type segment struct {
 	index                  *index
 	baseOffset, nextOffset uint64
 	config                 Config
+	// lastIndexed is the store position of the last indexed record.
+	lastIndexed uint64
+	sealed      bool
 }
 
 func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
@@ -24,7 +26,7 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 
 	var err error
 	storeFile, err := os.OpenFile(
-		filepath.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".store")),
+		filepath.Join(dir, segmentFileName(baseOffset, api.SegmentFile_STORE)),
 		os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644,
 	)
 
@@ -32,12 +34,12 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 		return nil, err
 	}
 
-	if s.store, err = newStore(storeFile); err != nil {
+	if s.store, err = newStore(storeFile, c); err != nil {
 		return nil, err
 	}
 
 	indexFile, err := os.OpenFile(
-		filepath.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".index")),
+		filepath.Join(dir, segmentFileName(baseOffset, api.SegmentFile_INDEX)),
 		os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644,
 	)
 	if err != nil {
@@ -48,10 +50,21 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 		return nil, err
 	}
 
-	if off, _, err := s.index.Read(-1); err != nil {
+	off, pos, err := s.index.Read(-1)
+	if err != nil {
 		s.nextOffset = baseOffset
-	} else {
-		s.nextOffset = baseOffset + uint64(off) + 1
+		return s, nil
+	}
+
+	s.nextOffset = baseOffset + uint64(off) + 1
+	s.lastIndexed = pos
+
+	// with a sparse index there can be records after the last indexed one.
+	for pos, err = s.store.next(pos); pos < s.store.size; pos, err = s.store.next(pos) {
+		if err != nil {
+			return nil, err
+		}
+		s.nextOffset++
 	}
 
 	return s, nil
@@ -65,38 +78,72 @@ func (s *segment) Append(record *api.Record) (offset uint64, err error) {
 		return 0, err
 	}
 
+	if p, err = compress(s.config.Segment.Compression, p); err != nil {
+		return 0, err
+	}
+
 	_, pos, err := s.store.Append(p)
 	if err != nil {
 		return 0, err
 	}
 
-	if err = s.index.Write(
-		uint32(s.nextOffset-uint64(s.baseOffset)),
-		pos,
-	); err != nil {
-		return 0, err
+	if s.shouldIndex(pos) {
+		if err = s.index.Write(
+			uint32(s.nextOffset-uint64(s.baseOffset)),
+			pos,
+		); err != nil {
+			return 0, err
+		}
+		s.lastIndexed = pos
 	}
 
 	s.nextOffset++
 	return cur, nil
 }
 
+func (s *segment) shouldIndex(pos uint64) bool {
+	return s.index.size == 0 ||
+		pos-s.lastIndexed >= s.config.Segment.IndexInterval
+}
+
 func (s *segment) Read(off uint64) (*api.Record, error) {
-	_, pos, err := s.index.Read(int64(off - s.baseOffset))
+	rel := uint32(off - s.baseOffset)
+	cur, pos, err := s.index.Search(rel)
 	if err != nil {
 		return nil, err
 	}
+
+	// scan forward from the nearest indexed record.
+	for ; cur < rel; cur++ {
+		if pos, err = s.store.next(pos); err != nil {
+			return nil, err
+		}
+	}
 	p, err := s.store.Read(pos)
 	if err != nil {
 		return nil, err
 	}
 
+	if p, err = decompress(p); err != nil {
+		return nil, err
+	}
+
 	record := &api.Record{}
 	err = proto.Unmarshal(p, record)
 
 	return record, err
 }
 
+// seal marks the segment as read-only, which maps its store into memory.
+func (s *segment) seal() error {
+	if err := s.store.seal(); err != nil {
+		return err
+	}
+
+	s.sealed = true
+	return nil
+}
+
 func (s *segment) IsMaxed() bool {
 	return s.store.size >= s.config.Segment.MaxStoreBytes ||
 		s.index.size >= s.config.Segment.MaxIndexBytes
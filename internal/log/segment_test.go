@@ -2,6 +2,7 @@ package log
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
@@ -87,3 +88,110 @@ func TestSegment(t *testing.T) {
 		t.Error("is maxed")
 	}
 }
+
+func TestSegmentCompression(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "segment-compression-test")
+	defer os.RemoveAll(dir)
+
+	want := &api.Record{Value: bytes.Repeat([]byte("hello world "), 32)}
+	c := Config{}
+	c.Segment.MaxStoreBytes = 4096
+	c.Segment.MaxIndexBytes = 1024
+
+	codecs := []Codec{CodecNone, CodecGzip, CodecSnappy, CodecZstd}
+	for _, codec := range codecs {
+		c.Segment.Compression = codec
+		s, err := newSegment(dir, 0, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = s.Append(want); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = s.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// records written with every codec should be readable from a segment
+	// configured with a different one.
+	c.Segment.Compression = CodecNone
+	s, err := newSegment(dir, 0, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Remove()
+
+	if uint64(len(codecs)) != s.nextOffset {
+		t.Fatalf("got next offset: %d, want: %d", s.nextOffset, len(codecs))
+	}
+
+	for off := uint64(0); off < s.nextOffset; off++ {
+		got, err := s.Read(off)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(want.Value, got.Value) {
+			t.Errorf("values are not equal for codec %s", codecs[off])
+		}
+	}
+
+	if uint64(len(want.Value)*2) < s.store.size {
+		t.Error("compressed records were not smaller")
+	}
+}
+
+func TestSegmentSparseIndex(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "segment-sparse-test")
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	c.Segment.IndexInterval = 64
+
+	s, err := newSegment(dir, 0, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 10
+	for i := 0; i < n; i++ {
+		want := &api.Record{Value: []byte(fmt.Sprintf("record %d", i))}
+		if _, err = s.Append(want); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if s.index.size >= n*entryWidth {
+		t.Errorf("index has %d entries, want less than %d", s.index.size/entryWidth, n)
+	}
+
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = newSegment(dir, 0, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Remove()
+
+	if uint64(n) != s.nextOffset {
+		t.Fatalf("got next offset: %d, want: %d", s.nextOffset, n)
+	}
+
+	for i := uint64(0); i < n; i++ {
+		got, err := s.Read(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if want := fmt.Sprintf("record %d", i); want != string(got.Value) {
+			t.Errorf("got value: %q, want: %q", got.Value, want)
+		}
+	}
+}
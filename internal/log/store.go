@@ -2,9 +2,15 @@ package log
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/cipher"
 	"encoding/binary"
+	"io"
 	"os"
 	"sync"
+	"sync/atomic"
+
+	"github.com/tysontate/gommap"
 )
 
 var (
@@ -20,20 +26,79 @@ type store struct {
 	mu   sync.Mutex
 	buf  *bufio.Writer
 	size uint64
+	// aead is set when the store's records are encrypted.
+	aead  cipher.AEAD
+	keyID uint32
+	// mmap holds a read-only gommap.MMap of the file once the store is
+	// sealed, which lets readers skip the mutex and read syscalls.
+	mmap atomic.Value
 }
 
-func newStore(f *os.File) (*store, error) {
+func newStore(f *os.File, c Config) (*store, error) {
 	fi, err := os.Stat(f.Name())
 	if err != nil {
 		return nil, err
 	}
 
-	size := uint64(fi.Size())
-	return &store{
+	s := &store{
 		File: f,
-		size: size,
+		size: uint64(fi.Size()),
 		buf:  bufio.NewWriter(f),
-	}, nil
+	}
+
+	if err := s.setupEncryption(c.Segment.Encryption); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// setupEncryption reads the key id from the header of an existing encrypted
+// store, or writes a header for the provider's current key if the store is
+// new. Plain stores stay plain even if a key provider is configured.
+func (s *store) setupEncryption(keys KeyProvider) error {
+	var (
+		key []byte
+		err error
+	)
+
+	switch {
+	case s.size >= headerWidth:
+		header := make([]byte, headerWidth)
+		if _, err := s.File.ReadAt(header, 0); err != nil {
+			return err
+		}
+
+		if !bytes.Equal(header[:len(encryptionMagic)], encryptionMagic) {
+			return nil
+		}
+
+		if keys == nil {
+			return ErrNoKeyProvider
+		}
+
+		s.keyID = enc.Uint32(header[len(encryptionMagic):])
+		if key, err = keys.Key(s.keyID); err != nil {
+			return err
+		}
+	case s.size == 0 && keys != nil:
+		if s.keyID, key, err = keys.CurrentKey(); err != nil {
+			return err
+		}
+
+		header := make([]byte, headerWidth)
+		copy(header, encryptionMagic)
+		enc.PutUint32(header[len(encryptionMagic):], s.keyID)
+		if _, err := s.buf.Write(header); err != nil {
+			return err
+		}
+		s.size = headerWidth
+	default:
+		return nil
+	}
+
+	s.aead, err = newGCM(key)
+	return err
 }
 
 func (s *store) Append(p []byte) (n uint64, pos uint64, err error) {
@@ -41,6 +106,12 @@ func (s *store) Append(p []byte) (n uint64, pos uint64, err error) {
 	defer s.mu.Unlock()
 
 	pos = s.size
+	if s.aead != nil {
+		if p, err = sealRecord(s.aead, pos, p); err != nil {
+			return 0, 0, err
+		}
+	}
+
 	if err := binary.Write(s.buf, enc, uint64(len(p))); err != nil {
 		return 0, 0, err
 	}
@@ -57,6 +128,35 @@ func (s *store) Append(p []byte) (n uint64, pos uint64, err error) {
 }
 
 func (s *store) Read(pos uint64) ([]byte, error) {
+	b, err := s.readRecord(pos)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.aead != nil {
+		return openRecord(s.aead, pos, b)
+	}
+
+	return b, nil
+}
+
+func (s *store) readRecord(pos uint64) ([]byte, error) {
+	if m := s.mapped(); m != nil {
+		if uint64(len(m)) < pos+lenWidth {
+			return nil, io.EOF
+		}
+
+		end := pos + lenWidth + enc.Uint64(m[pos:pos+lenWidth])
+		if uint64(len(m)) < end {
+			return nil, io.ErrUnexpectedEOF
+		}
+
+		// copy the record since the mapping goes away when the store closes.
+		b := make([]byte, end-pos-lenWidth)
+		copy(b, m[pos+lenWidth:end])
+		return b, nil
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -77,7 +177,45 @@ func (s *store) Read(pos uint64) ([]byte, error) {
 	return b, nil
 }
 
+// next returns the position of the record following the one at pos.
+func (s *store) next(pos uint64) (uint64, error) {
+	if m := s.mapped(); m != nil {
+		if uint64(len(m)) < pos+lenWidth {
+			return 0, io.EOF
+		}
+
+		return pos + lenWidth + enc.Uint64(m[pos:pos+lenWidth]), nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.buf.Flush(); err != nil {
+		return 0, err
+	}
+
+	size := make([]byte, lenWidth)
+	if _, err := s.File.ReadAt(size, int64(pos)); err != nil {
+		return 0, err
+	}
+
+	return pos + lenWidth + enc.Uint64(size), nil
+}
+
 func (s *store) ReadAt(p []byte, off int64) (int, error) {
+	if m := s.mapped(); m != nil {
+		if off >= int64(len(m)) {
+			return 0, io.EOF
+		}
+
+		n := copy(p, m[off:])
+		if n < len(p) {
+			return n, io.EOF
+		}
+
+		return n, nil
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -88,10 +226,51 @@ func (s *store) ReadAt(p []byte, off int64) (int, error) {
 	return s.File.ReadAt(p, off)
 }
 
+// seal flushes the store and maps it read-only. The store must not be
+// appended to after it's sealed.
+func (s *store) seal() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.mapped() != nil || s.size == 0 {
+		return nil
+	}
+
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+
+	m, err := gommap.MapRegion(
+		s.File.Fd(),
+		0,
+		int64(s.size),
+		gommap.PROT_READ,
+		gommap.MAP_SHARED,
+	)
+	if err != nil {
+		return err
+	}
+
+	s.mmap.Store(m)
+	return nil
+}
+
+func (s *store) mapped() gommap.MMap {
+	m, _ := s.mmap.Load().(gommap.MMap)
+	return m
+}
+
 func (s *store) Close() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if m := s.mapped(); m != nil {
+		if err := m.UnsafeUnmap(); err != nil {
+			return err
+		}
+		s.mmap.Store(gommap.MMap(nil))
+	}
+
 	if err := s.buf.Flush(); err != nil {
 		return err
 	}
@@ -2,6 +2,8 @@ package log
 
 import (
 	"bytes"
+	"encoding/base64"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"testing"
@@ -83,7 +85,7 @@ func TestStoreAppendRead(t *testing.T) {
 	}
 	defer os.Remove(f.Name())
 
-	s, err := newStore(f)
+	s, err := newStore(f, Config{})
 	if err != nil {
 		t.Fatalf("could not create store: %s", err)
 	}
@@ -92,7 +94,7 @@ func TestStoreAppendRead(t *testing.T) {
 	testRead(t, s)
 	testReadAt(t, s)
 
-	s, err = newStore(f)
+	s, err = newStore(f, Config{})
 	if err != nil {
 		t.Fatalf("could not open store again")
 	}
@@ -106,7 +108,7 @@ func TestStoreClose(t *testing.T) {
 	}
 	defer os.Remove(f.Name())
 
-	s, err := newStore(f)
+	s, err := newStore(f, Config{})
 	if err != nil {
 		t.Fatalf("could not create store: %s", err)
 	}
@@ -149,3 +151,171 @@ func openFile(name string) (file *os.File, size int64, err error) {
 
 	return f, fi.Size(), nil
 }
+
+func writeKeyFile(t *testing.T, keys ...string) string {
+	t.Helper()
+	f, err := ioutil.TempFile("", "store_keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for i, key := range keys {
+		fmt.Fprintf(f, "%d:%s\n", i+1, base64.StdEncoding.EncodeToString([]byte(key)))
+	}
+
+	return f.Name()
+}
+
+func TestStoreEncryption(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_encryption_test")
+	if err != nil {
+		t.Fatalf("could not create temp file: %s", err)
+	}
+	defer os.Remove(f.Name())
+
+	keyFile := writeKeyFile(t, "0123456789abcdef0123456789abcdef")
+	defer os.Remove(keyFile)
+
+	keys, err := NewFileKeyProvider(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := Config{}
+	c.Segment.Encryption = keys
+	s, err := newStore(f, c)
+	if err != nil {
+		t.Fatalf("could not create store: %s", err)
+	}
+
+	_, pos, err := s.Append(write)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Contains(raw, write) {
+		t.Error("store contains plaintext record")
+	}
+
+	f, _, err = openFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = newStore(f, Config{}); err != ErrNoKeyProvider {
+		t.Errorf("got err: %v, want: %v", err, ErrNoKeyProvider)
+	}
+
+	// rotate to a new key, the old one should still be used for this store.
+	rotated := writeKeyFile(t, "0123456789abcdef0123456789abcdef", "fedcba9876543210fedcba9876543210")
+	defer os.Remove(rotated)
+
+	keys, err = NewFileKeyProvider(rotated)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Segment.Encryption = keys
+	s, err = newStore(f, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.keyID != 1 {
+		t.Errorf("got key id: %d, want: 1", s.keyID)
+	}
+
+	read, err := s.Read(pos)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(write, read) {
+		t.Error("values are not equal")
+	}
+}
+
+func TestStoreSeal(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_seal_test")
+	if err != nil {
+		t.Fatalf("could not create temp file: %s", err)
+	}
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f, Config{})
+	if err != nil {
+		t.Fatalf("could not create store: %s", err)
+	}
+
+	testAppend(t, s)
+	if err = s.seal(); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.mapped() == nil {
+		t.Fatal("sealed store is not mapped")
+	}
+
+	testRead(t, s)
+	testReadAt(t, s)
+
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func benchmarkStoreRead(b *testing.B, sealed bool) {
+	f, err := ioutil.TempFile("", "store_read_benchmark")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f, Config{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer s.Close()
+
+	const records = 1024
+	positions := make([]uint64, records)
+	for i := range positions {
+		if _, positions[i], err = s.Append(write); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	if sealed {
+		if err = s.seal(); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			if _, err := s.Read(positions[i%records]); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkStoreRead(b *testing.B) {
+	benchmarkStoreRead(b, false)
+}
+
+func BenchmarkStoreReadSealed(b *testing.B) {
+	benchmarkStoreRead(b, true)
+}
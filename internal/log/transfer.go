@@ -0,0 +1,206 @@
+package log
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	api "github.com/nireo/dilog/api/v1"
+)
+
+var (
+	ErrSegmentNotFound  = errors.New("segment not found")
+	ErrSegmentNotSealed = errors.New("segment is still being written to")
+)
+
+// Segments describes the log's segments, oldest first.
+func (l *Log) Segments() []*api.SegmentInfo {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	infos := make([]*api.SegmentInfo, len(l.segments))
+	for i, s := range l.segments {
+		infos[i] = &api.SegmentInfo{
+			BaseOffset: s.baseOffset,
+			NextOffset: s.nextOffset,
+			StoreSize:  s.store.size,
+			IndexSize:  s.index.size,
+			Sealed:     s.sealed,
+		}
+	}
+
+	return infos
+}
+
+// OpenSegment returns a reader for the raw bytes of a sealed segment's store
+// or index file, starting at pos. Reading stops at length bytes, or at the end
+// of the file's contents if length is zero. The reader uses its own file
+// handle, so it stays valid even if the segment is removed while reading.
+func (l *Log) OpenSegment(
+	base uint64,
+	file api.SegmentFile,
+	pos, length uint64,
+) (io.ReadCloser, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	var s *segment
+	for _, segment := range l.segments {
+		if segment.baseOffset == base {
+			s = segment
+			break
+		}
+	}
+
+	if s == nil {
+		return nil, ErrSegmentNotFound
+	}
+
+	if !s.sealed {
+		return nil, ErrSegmentNotSealed
+	}
+
+	name, size := s.store.Name(), s.store.size
+	if file == api.SegmentFile_INDEX {
+		name, size = s.index.Name(), s.index.size
+	}
+
+	if pos > size {
+		return nil, fmt.Errorf("position %d is past the end of %s", pos, name)
+	}
+
+	if length == 0 || length > size-pos {
+		length = size - pos
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := f.Seek(int64(pos), io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &segmentReader{
+		f: f,
+		r: io.LimitedReader{R: f, N: int64(length)},
+	}, nil
+}
+
+type segmentReader struct {
+	f *os.File
+	r io.LimitedReader
+}
+
+func (s *segmentReader) Read(p []byte) (int, error) {
+	return s.r.Read(p)
+}
+
+// WriteTo hands the file to w as an *io.LimitedReader, which lets connections
+// that support it copy the bytes with sendfile instead of through userspace.
+func (s *segmentReader) WriteTo(w io.Writer) (int64, error) {
+	if rf, ok := w.(io.ReaderFrom); ok {
+		return rf.ReadFrom(&s.r)
+	}
+
+	return io.Copy(w, &s.r)
+}
+
+// Len returns the number of bytes left to read.
+func (s *segmentReader) Len() int64 {
+	return s.r.N
+}
+
+func (s *segmentReader) Close() error {
+	return s.f.Close()
+}
+
+// Download copies the sealed segments of the log served by client into dir,
+// so a log opened there starts out with the same records. Segments that
+// already exist in dir are skipped.
+func Download(ctx context.Context, client api.LogClient, dir string) (int, error) {
+	res, err := client.ListSegments(ctx, &api.ListSegmentsRequest{})
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	for _, info := range res.Segments {
+		if !info.Sealed {
+			continue
+		}
+
+		for _, file := range []api.SegmentFile{api.SegmentFile_STORE, api.SegmentFile_INDEX} {
+			name := filepath.Join(dir, segmentFileName(info.BaseOffset, file))
+			if _, err := os.Stat(name); err == nil {
+				continue
+			}
+
+			if err := downloadFile(ctx, client, info.BaseOffset, file, name); err != nil {
+				return n, err
+			}
+		}
+		n++
+	}
+
+	return n, nil
+}
+
+func downloadFile(
+	ctx context.Context,
+	client api.LogClient,
+	base uint64,
+	file api.SegmentFile,
+	name string,
+) error {
+	stream, err := client.FetchSegment(ctx, &api.FetchSegmentRequest{
+		BaseOffset: base,
+		File:       file,
+	})
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first so a failed download doesn't leave a
+	// partial segment behind.
+	f, err := ioutil.TempFile(filepath.Dir(name), filepath.Base(name)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	for {
+		res, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			f.Close()
+			return err
+		}
+
+		if _, err := f.Write(res.Data); err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), name)
+}
+
+func segmentFileName(base uint64, file api.SegmentFile) string {
+	if file == api.SegmentFile_INDEX {
+		return fmt.Sprintf("%d%s", base, ".index")
+	}
+	return fmt.Sprintf("%d%s", base, ".store")
+}
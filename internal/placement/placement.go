@@ -0,0 +1,163 @@
+// Package placement decides which nodes hold the replicas of each log. Logs
+// are keyed by the node they originate on.
+//
+// Replicas are ranked with rendezvous hashing, so adding or removing a node
+// only moves the logs it ranks highest for, and are spread across zones: a
+// zone only gets a second replica once every zone has one.
+package placement
+
+import (
+	"hash/fnv"
+	"sort"
+)
+
+// Node is a member of the cluster that can hold replicas.
+type Node struct {
+	Name string
+	// Zone is the node's failure domain. Nodes that don't advertise one are
+	// all considered to be in the same zone.
+	Zone  string
+	Alive bool
+}
+
+// Placement is where a log's replicas are placed.
+type Placement struct {
+	// Log is the name of the node the log originates on.
+	Log string
+	// Replicas are the alive nodes holding the log, the first one leads.
+	Replicas []Node
+	// Factor is the number of replicas wanted.
+	Factor int
+	// Zones is the number of zones the replicas are in and WantZones the
+	// number they'd be in if every zone in the cluster had an alive node.
+	Zones     int
+	WantZones int
+}
+
+// Leader returns the node leading the log and whether there's one at all.
+func (p Placement) Leader() (Node, bool) {
+	if len(p.Replicas) == 0 {
+		return Node{}, false
+	}
+	return p.Replicas[0], true
+}
+
+// UnderReplicated reports whether the log has fewer replicas than wanted.
+func (p Placement) UnderReplicated() bool {
+	return len(p.Replicas) < p.Factor
+}
+
+// UnderReplicatedZones reports whether the replicas are in fewer zones than
+// they would be if every zone was healthy.
+func (p Placement) UnderReplicatedZones() bool {
+	return p.Zones < p.WantZones
+}
+
+// Has reports whether the named node holds a replica of the log.
+func (p Placement) Has(name string) bool {
+	for _, n := range p.Replicas {
+		if n.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Place picks factor alive nodes to hold the log. The node the log
+// originates on leads it while it's alive, otherwise the highest ranked node
+// does. Nodes that aren't alive only count towards the zones the cluster
+// spans.
+func Place(log string, nodes []Node, factor int) Placement {
+	p := Placement{Log: log, Factor: factor}
+
+	zones := make(map[string]bool)
+	var candidates []Node
+	for _, n := range nodes {
+		zones[n.Zone] = true
+		if n.Alive {
+			candidates = append(candidates, n)
+		}
+	}
+
+	p.WantZones = len(zones)
+	if factor < p.WantZones {
+		p.WantZones = factor
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].Name == log || candidates[j].Name == log {
+			return candidates[i].Name == log
+		}
+
+		si, sj := score(log, candidates[i].Name), score(log, candidates[j].Name)
+		if si != sj {
+			return si > sj
+		}
+		return candidates[i].Name < candidates[j].Name
+	})
+
+	// pick the highest ranked node of every zone first, then fill up the
+	// rest in rank order.
+	picked := make([]bool, len(candidates))
+	used := make(map[string]bool)
+	for i, n := range candidates {
+		if len(p.Replicas) == factor {
+			break
+		}
+		if used[n.Zone] {
+			continue
+		}
+
+		used[n.Zone] = true
+		picked[i] = true
+		p.Replicas = append(p.Replicas, n)
+	}
+
+	for i, n := range candidates {
+		if len(p.Replicas) == factor {
+			break
+		}
+		if picked[i] {
+			continue
+		}
+
+		p.Replicas = append(p.Replicas, n)
+	}
+
+	p.Zones = len(used)
+	return p
+}
+
+// PlaceAll places the log of every node in the cluster.
+func PlaceAll(nodes []Node, factor int) []Placement {
+	placements := make([]Placement, 0, len(nodes))
+	for _, n := range nodes {
+		placements = append(placements, Place(n.Name, nodes, factor))
+	}
+
+	sort.Slice(placements, func(i, j int) bool {
+		return placements[i].Log < placements[j].Log
+	})
+
+	return placements
+}
+
+// score is the node's rendezvous weight for the log.
+func score(log, node string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(log))
+	h.Write([]byte{0})
+	h.Write([]byte(node))
+	return mix(h.Sum64())
+}
+
+// mix is splitmix64's finalizer. FNV's output is poorly distributed for
+// inputs that only differ in their last bytes, like node names.
+func mix(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,136 @@
+package placement
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// cluster returns n alive nodes spread round robin over the zones.
+func cluster(n int, zones ...string) []Node {
+	var nodes []Node
+	for i := 0; i < n; i++ {
+		nodes = append(nodes, Node{
+			Name:  fmt.Sprintf("node-%d", i),
+			Zone:  zones[i%len(zones)],
+			Alive: true,
+		})
+	}
+	return nodes
+}
+
+func names(nodes []Node) []string {
+	var res []string
+	for _, n := range nodes {
+		res = append(res, n.Name)
+	}
+	return res
+}
+
+func TestPlace(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T){
+		"origin leads":           testOriginLeads,
+		"spread across zones":    testSpreadAcrossZones,
+		"failed zone":            testFailedZone,
+		"stable when nodes move": testStable,
+		"small cluster":          testSmallCluster,
+	} {
+		t.Run(scenario, fn)
+	}
+}
+
+func testOriginLeads(t *testing.T) {
+	nodes := cluster(6, "a", "b", "c")
+
+	p := Place("node-4", nodes, 3)
+	leader, ok := p.Leader()
+	if !ok || leader.Name != "node-4" {
+		t.Fatalf("got leader: %s, want: node-4", leader.Name)
+	}
+
+	// once the origin fails another node takes over.
+	nodes[4].Alive = false
+	p = Place("node-4", nodes, 3)
+	leader, ok = p.Leader()
+	if !ok || leader.Name == "node-4" {
+		t.Fatalf("got leader: %s", leader.Name)
+	}
+
+	if p.Has("node-4") {
+		t.Fatal("failed node holds a replica")
+	}
+}
+
+func testSpreadAcrossZones(t *testing.T) {
+	nodes := cluster(9, "a", "b", "c")
+
+	for _, n := range nodes {
+		p := Place(n.Name, nodes, 3)
+		if len(p.Replicas) != 3 {
+			t.Fatalf("got %d replicas, want: 3", len(p.Replicas))
+		}
+
+		zones := make(map[string]bool)
+		for _, r := range p.Replicas {
+			zones[r.Zone] = true
+		}
+
+		if len(zones) != 3 || p.Zones != 3 || p.UnderReplicatedZones() {
+			t.Fatalf("replicas %v are in %d zones, want: 3", names(p.Replicas), len(zones))
+		}
+	}
+}
+
+func testFailedZone(t *testing.T) {
+	nodes := cluster(6, "a", "b", "c")
+	for i := range nodes {
+		if nodes[i].Zone == "c" {
+			nodes[i].Alive = false
+		}
+	}
+
+	p := Place("node-0", nodes, 3)
+	if p.UnderReplicated() {
+		t.Fatalf("got %d replicas, want: 3", len(p.Replicas))
+	}
+
+	if !p.UnderReplicatedZones() || p.Zones != 2 || p.WantZones != 3 {
+		t.Fatalf("got %d of %d zones", p.Zones, p.WantZones)
+	}
+}
+
+func testStable(t *testing.T) {
+	nodes := cluster(10, "a", "b")
+	before := Place("node-0", nodes, 2)
+
+	// removing nodes that don't hold the log doesn't move it.
+	var remaining []Node
+	for _, n := range nodes {
+		if before.Has(n.Name) || n.Name == "node-9" {
+			remaining = append(remaining, n)
+		}
+	}
+
+	after := Place("node-0", remaining, 2)
+	if !reflect.DeepEqual(names(before.Replicas), names(after.Replicas)) {
+		t.Fatalf("replicas moved from %v to %v", names(before.Replicas), names(after.Replicas))
+	}
+}
+
+func testSmallCluster(t *testing.T) {
+	nodes := cluster(2, "a")
+
+	p := Place("node-0", nodes, 3)
+	if !p.UnderReplicated() || len(p.Replicas) != 2 {
+		t.Fatalf("got %d replicas, want: 2", len(p.Replicas))
+	}
+
+	if p.UnderReplicatedZones() {
+		t.Fatal("single zone cluster is under-replicated by zone")
+	}
+
+	placements := PlaceAll(nodes, 3)
+	if len(placements) != 2 || placements[0].Log != "node-0" {
+		t.Fatalf("got placements: %v", placements)
+	}
+}
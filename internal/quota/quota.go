@@ -0,0 +1,271 @@
+// Package quota limits how fast each subject may produce and consume.
+package quota
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/nireo/dilog/internal/watch"
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+)
+
+// idleTimeout is how long a subject's buckets can go unused before they're
+// dropped, once they've filled up again. Subjects come and go with
+// short-lived certificates and tokens, so their buckets can't be kept
+// forever.
+const idleTimeout = 10 * time.Minute
+
+// Limit is a subject's quota for an action. Zero rates are unlimited. The
+// bursts default to a second's worth of the rate.
+type Limit struct {
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	RequestBurst      int     `json:"request_burst"`
+	BytesPerSecond    float64 `json:"bytes_per_second"`
+	ByteBurst         int     `json:"byte_burst"`
+}
+
+// Limits are keyed by action, produce or consume.
+type Limits map[string]Limit
+
+// Config is the quota file's contents. Subjects without limits of their own
+// for an action get the default ones.
+type Config struct {
+	Default  Limits            `json:"default"`
+	Subjects map[string]Limits `json:"subjects"`
+}
+
+func (c Config) limit(subject, action string) Limit {
+	if limit, ok := c.Subjects[subject][action]; ok {
+		return limit
+	}
+	return c.Default[action]
+}
+
+// Quotas enforces the limits in a quota file, with a token bucket per
+// subject and action.
+type Quotas struct {
+	file   string
+	logger *zap.Logger
+
+	mu       sync.Mutex
+	config   Config
+	limiters map[limiterKey]*limiter
+	// evicted is when idle limiters were last dropped.
+	evicted time.Time
+
+	watcher *watch.Watcher
+}
+
+type limiterKey struct {
+	subject string
+	action  string
+}
+
+// limiter holds the buckets of a subject's action, which are nil if it's
+// unlimited.
+type limiter struct {
+	requests *rate.Limiter
+	bytes    *rate.Limiter
+	used     time.Time
+}
+
+// New reads the quotas from file, which keep being used until Reload or
+// the watcher started by Watch reads it again.
+func New(file string) (*Quotas, error) {
+	q := &Quotas{
+		file:   file,
+		logger: zap.L().Named("quota"),
+	}
+
+	if err := q.Reload(); err != nil {
+		return nil, err
+	}
+
+	return q, nil
+}
+
+// Reload reads the quota file again and starts the buckets over with the
+// new limits. If it doesn't parse, the current limits stay in effect.
+func (q *Quotas) Reload() error {
+	b, err := ioutil.ReadFile(q.file)
+	if err != nil {
+		return err
+	}
+
+	var config Config
+	if err := json.Unmarshal(b, &config); err != nil {
+		return fmt.Errorf("parsing quota file: %w", err)
+	}
+
+	q.mu.Lock()
+	q.config = config
+	q.limiters = make(map[limiterKey]*limiter)
+	q.mu.Unlock()
+
+	return nil
+}
+
+// Allow takes a request of n bytes out of the subject's quota for the
+// action. If there isn't enough left, nothing is taken and it returns how
+// long until there will be. A zero n only checks that the subject isn't
+// over its byte quota, for requests whose size is charged once handled.
+func (q *Quotas) Allow(subject, action string, n int) time.Duration {
+	l := q.limiter(subject, action)
+	if l == nil {
+		return 0
+	}
+
+	now := time.Now()
+	req := l.requests.ReserveN(now, 1)
+	if delay := req.DelayFrom(now); delay > 0 {
+		req.CancelAt(now)
+		return delay
+	}
+
+	bytes := l.bytes.ReserveN(now, clamp(n, 1, l.bytes.Burst()))
+	delay := bytes.DelayFrom(now)
+	if n == 0 || delay > 0 {
+		bytes.CancelAt(now)
+	}
+	if delay > 0 {
+		req.CancelAt(now)
+	}
+
+	return delay
+}
+
+// Charge takes n bytes out of the subject's quota for the action even if
+// that puts it over, so its next requests wait until it's paid back.
+func (q *Quotas) Charge(subject, action string, n int) {
+	l := q.limiter(subject, action)
+	if l == nil || n <= 0 {
+		return
+	}
+
+	now := time.Now()
+	for n > 0 {
+		chunk := clamp(n, 1, l.bytes.Burst())
+		l.bytes.ReserveN(now, chunk)
+		n -= chunk
+	}
+}
+
+// limiter returns the subject's buckets for the action, or nil if it's
+// unlimited.
+func (q *Quotas) limiter(subject, action string) *limiter {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(q.evicted) >= idleTimeout {
+		q.evict(now)
+	}
+
+	key := limiterKey{subject: subject, action: action}
+	l, ok := q.limiters[key]
+	if !ok {
+		l = &limiter{}
+		if limit := q.config.limit(subject, action); limit.RequestsPerSecond > 0 || limit.BytesPerSecond > 0 {
+			l.requests = newLimiter(limit.RequestsPerSecond, limit.RequestBurst)
+			l.bytes = newLimiter(limit.BytesPerSecond, limit.ByteBurst)
+		}
+		q.limiters[key] = l
+	}
+	l.used = now
+
+	if l.requests == nil {
+		return nil
+	}
+	return l
+}
+
+// evict drops the limiters that haven't been used for idleTimeout and have
+// filled up again, so dropping them doesn't let their subjects off their
+// debts.
+func (q *Quotas) evict(now time.Time) {
+	for key, l := range q.limiters {
+		if now.Sub(l.used) >= idleTimeout && l.full(now) {
+			delete(q.limiters, key)
+		}
+	}
+	q.evicted = now
+}
+
+func (l *limiter) full(now time.Time) bool {
+	for _, bucket := range []*rate.Limiter{l.requests, l.bytes} {
+		if bucket == nil {
+			continue
+		}
+
+		r := bucket.ReserveN(now, bucket.Burst())
+		full := r.OK() && r.DelayFrom(now) == 0
+		r.CancelAt(now)
+		if !full {
+			return false
+		}
+	}
+	return true
+}
+
+func newLimiter(perSecond float64, burst int) *rate.Limiter {
+	if perSecond <= 0 {
+		return rate.NewLimiter(rate.Inf, 1)
+	}
+
+	if burst <= 0 {
+		burst = int(math.Ceil(perSecond))
+	}
+
+	return rate.NewLimiter(rate.Limit(perSecond), burst)
+}
+
+// clamp keeps requests bigger than the burst from being refused forever, they
+// take the whole burst instead.
+func clamp(n, min, max int) int {
+	if n < min {
+		return min
+	}
+	if n > max {
+		return max
+	}
+	return n
+}
+
+// Watch reloads the quotas whenever the file changes, until the quotas are
+// closed.
+func (q *Quotas) Watch() error {
+	w, err := watch.Files([]string{q.file}, q.logger, q.reloadChanged)
+	if err != nil {
+		return err
+	}
+
+	q.watcher = w
+	return nil
+}
+
+// reloadChanged reloads the quotas after the file changed.
+func (q *Quotas) reloadChanged() {
+	if err := q.Reload(); err != nil {
+		q.logger.Error(
+			"failed to reload quotas, keeping the current ones",
+			zap.String("file", q.file),
+			zap.Error(err),
+		)
+		return
+	}
+	q.logger.Info("reloaded quotas", zap.String("file", q.file))
+}
+
+// Close stops watching the file.
+func (q *Quotas) Close() error {
+	if q.watcher == nil {
+		return nil
+	}
+
+	return q.watcher.Close()
+}
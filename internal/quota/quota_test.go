@@ -0,0 +1,49 @@
+package quota
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEvict(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quota-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	b, err := json.Marshal(Config{
+		Default: Limits{"produce": {RequestsPerSecond: 1, BytesPerSecond: 1}},
+	})
+	require.NoError(t, err)
+
+	file := filepath.Join(dir, "quotas.json")
+	require.NoError(t, ioutil.WriteFile(file, b, 0644))
+
+	q, err := New(file)
+	require.NoError(t, err)
+
+	require.Zero(t, q.Allow("idle", "produce", 1))
+	require.Zero(t, q.Allow("unlimited", "consume", 1))
+	q.Charge("indebted", "produce", 1<<20)
+
+	now := time.Now()
+	// recent is used again just before the sweep.
+	require.Zero(t, q.Allow("recent", "produce", 1))
+	q.limiters[limiterKey{"recent", "produce"}].used = now.Add(idleTimeout)
+
+	q.evict(now.Add(idleTimeout + time.Second))
+
+	var kept []string
+	for key := range q.limiters {
+		kept = append(kept, key.subject)
+	}
+
+	// idle buckets that have filled up again are dropped, buckets still
+	// paying off a charge are kept until they have.
+	require.ElementsMatch(t, []string{"indebted", "recent"}, kept)
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+
+	api "github.com/nireo/dilog/api/v1"
+)
+
+// segmentMethod is the method audit entries of segment protocol requests
+// are recorded with.
+const segmentMethod = "segments/Fetch"
+
+// AuditLog records who made which calls.
+type AuditLog interface {
+	Record(entry *api.AuditEntry) error
+}
+
+// AuditQuerier is implemented by audit logs that can be searched.
+type AuditQuerier interface {
+	Query(req *api.QueryAuditRequest) (*api.QueryAuditResponse, error)
+}
+
+// auditCall collects the audit entry of a call while it's handled. Calls
+// are recorded once they end, so the entries of streams cover every record
+// they wrote or read. Streams are recorded once they're authorized too, as
+// they can run for as long as the client likes.
+type auditCall struct {
+	entry *api.AuditEntry
+
+	// audit is set for streams, which haven't been recorded as started yet.
+	audit AuditLog
+}
+
+type auditCallContextKey struct{}
+
+// authorize authorizes the call's subject and notes what it was authorized
+// for in the call's audit entry, even if it was denied. Streams calling it
+// several times are recorded with the last object.
+func (s *grpcServer) authorize(ctx context.Context, object, action string) error {
+	sub := subject(ctx)
+	call, ok := ctx.Value(auditCallContextKey{}).(*auditCall)
+	if ok {
+		call.entry.Subject = sub
+		call.entry.Object = object
+		call.entry.Action = action
+	}
+
+	err := s.Authorizer.Authorize(sub, object, action)
+	if ok && err == nil && call.audit != nil {
+		recordStarted(call.audit, call.entry)
+		call.audit = nil
+	}
+
+	return err
+}
+
+// auditOffsets adds the offsets to the range of the call's audit entry.
+func auditOffsets(ctx context.Context, first, last uint64) {
+	call, ok := ctx.Value(auditCallContextKey{}).(*auditCall)
+	if !ok {
+		return
+	}
+
+	entry := call.entry
+	if !entry.HasOffsets || first < entry.FirstOffset {
+		entry.FirstOffset = first
+	}
+	if !entry.HasOffsets || last > entry.LastOffset {
+		entry.LastOffset = last
+	}
+	entry.HasOffsets = true
+}
+
+func auditUnaryInterceptor(config *Config) grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context,
+		req interface{},
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		if config.Audit == nil {
+			return handler(ctx, req)
+		}
+
+		call := &auditCall{entry: &api.AuditEntry{Method: info.FullMethod}}
+		res, err := handler(context.WithValue(ctx, auditCallContextKey{}, call), req)
+		recordAudit(config.Audit, call.entry, err)
+
+		return res, err
+	}
+}
+
+func auditStreamInterceptor(config *Config) grpc.StreamServerInterceptor {
+	return func(
+		srv interface{},
+		stream grpc.ServerStream,
+		info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler,
+	) error {
+		if config.Audit == nil {
+			return handler(srv, stream)
+		}
+
+		call := &auditCall{
+			entry: &api.AuditEntry{Method: info.FullMethod},
+			audit: config.Audit,
+		}
+		wrapped := grpc_middleware.WrapServerStream(stream)
+		wrapped.WrappedContext = context.WithValue(stream.Context(), auditCallContextKey{}, call)
+
+		err := handler(srv, wrapped)
+		recordAudit(config.Audit, call.entry, err)
+
+		return err
+	}
+}
+
+// recordAudit records the entry of a call that ended with err. Calls that
+// didn't get as far as being authorized aren't recorded. Failing to record
+// is logged rather than failing the call, which has already happened.
+func recordAudit(audit AuditLog, entry *api.AuditEntry, err error) {
+	if entry.Action == "" {
+		return
+	}
+
+	entry.Time = time.Now().UnixNano()
+	entry.Result = status.Code(err).String()
+	record(audit, entry)
+}
+
+// recordStarted records that the stream of the entry started, without the
+// result and offsets it only has once it ends.
+func recordStarted(audit AuditLog, entry *api.AuditEntry) {
+	record(audit, &api.AuditEntry{
+		Time:    time.Now().UnixNano(),
+		Subject: entry.Subject,
+		Action:  entry.Action,
+		Object:  entry.Object,
+		Method:  entry.Method,
+		Started: true,
+	})
+}
+
+func record(audit AuditLog, entry *api.AuditEntry) {
+	if err := audit.Record(entry); err != nil {
+		zap.L().Named("server").Error(
+			"failed to record audit entry",
+			zap.String("method", entry.Method),
+			zap.String("subject", entry.Subject),
+			zap.Error(err),
+		)
+	}
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+
+	"github.com/soheilhy/cmux"
+	"google.golang.org/grpc/credentials"
+)
+
+// MuxCredentials returns gRPC transport credentials for connections accepted
+// from a TLS listener that a cmux routes by their decrypted bytes. The
+// listener already did the handshake, so the server side only exposes the
+// connection's TLS state for authenticating the client.
+func MuxCredentials(tlsConfig *tls.Config) credentials.TransportCredentials {
+	return &muxCredentials{TransportCredentials: credentials.NewTLS(tlsConfig)}
+}
+
+type muxCredentials struct {
+	credentials.TransportCredentials
+}
+
+func (c *muxCredentials) ServerHandshake(conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	raw := conn
+	if mc, ok := conn.(*cmux.MuxConn); ok {
+		raw = mc.Conn
+	}
+
+	tlsConn, ok := raw.(*tls.Conn)
+	if !ok {
+		return nil, nil, errors.New("connection wasn't accepted over TLS")
+	}
+
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, nil, err
+	}
+
+	return conn, credentials.TLSInfo{
+		State: tlsConn.ConnectionState(),
+		CommonAuthInfo: credentials.CommonAuthInfo{
+			SecurityLevel: credentials.PrivacyAndIntegrity,
+		},
+	}, nil
+}
+
+func (c *muxCredentials) Clone() credentials.TransportCredentials {
+	return &muxCredentials{TransportCredentials: c.TransportCredentials.Clone()}
+}
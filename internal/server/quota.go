@@ -0,0 +1,153 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	api "github.com/nireo/dilog/api/v1"
+)
+
+// Quotas limits how fast each subject may produce and consume.
+type Quotas interface {
+	// Allow takes a request of n bytes out of the subject's quota for the
+	// action, or returns how long until there's enough quota left for it.
+	Allow(subject, action string, n int) time.Duration
+	// Charge takes n bytes out of the subject's quota, for requests whose
+	// size is only known once they've been handled.
+	Charge(subject, action string, n int)
+}
+
+// quotaActions maps the methods that are subject to quotas to their action.
+var quotaActions = map[string]string{
+	"/log.v1.Log/Produce":       produceAction,
+	"/log.v1.Log/ProduceStream": produceAction,
+	"/log.v1.Log/Consume":       consumeAction,
+	"/log.v1.Log/ConsumeStream": consumeAction,
+}
+
+// quotaUnaryInterceptor refuses calls over their subject's quota with
+// ResourceExhausted, telling the client when to retry.
+func quotaUnaryInterceptor(config *Config) grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context,
+		req interface{},
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		action, ok := quotaActions[info.FullMethod]
+		if config.Quotas == nil || !ok {
+			return handler(ctx, req)
+		}
+
+		sub := subject(ctx)
+		if delay := config.Quotas.Allow(sub, action, messageBytes(req)); delay > 0 {
+			return nil, quotaExceeded(sub, action, delay)
+		}
+
+		res, err := handler(ctx, req)
+		if err == nil && action == consumeAction {
+			config.Quotas.Charge(sub, action, messageBytes(res))
+		}
+
+		return res, err
+	}
+}
+
+// quotaStreamInterceptor slows streams over their subject's quota down
+// instead of failing them, by waiting for quota before handing over each
+// message.
+func quotaStreamInterceptor(config *Config) grpc.StreamServerInterceptor {
+	return func(
+		srv interface{},
+		stream grpc.ServerStream,
+		info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler,
+	) error {
+		action, ok := quotaActions[info.FullMethod]
+		if config.Quotas == nil || !ok {
+			return handler(srv, stream)
+		}
+
+		return handler(srv, &quotaStream{
+			ServerStream: stream,
+			quotas:       config.Quotas,
+			subject:      subject(stream.Context()),
+			action:       action,
+		})
+	}
+}
+
+type quotaStream struct {
+	grpc.ServerStream
+	quotas  Quotas
+	subject string
+	action  string
+}
+
+func (s *quotaStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+
+	if s.action != produceAction {
+		return nil
+	}
+
+	return s.wait(messageBytes(m))
+}
+
+func (s *quotaStream) SendMsg(m interface{}) error {
+	if s.action == consumeAction {
+		if err := s.wait(0); err != nil {
+			return err
+		}
+		s.quotas.Charge(s.subject, s.action, messageBytes(m))
+	}
+
+	return s.ServerStream.SendMsg(m)
+}
+
+// wait blocks until the subject has quota for a message of n bytes.
+func (s *quotaStream) wait(n int) error {
+	for {
+		delay := s.quotas.Allow(s.subject, s.action, n)
+		if delay == 0 {
+			return nil
+		}
+
+		select {
+		case <-s.Context().Done():
+			return status.FromContextError(s.Context().Err()).Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// messageBytes returns the size of the record the message carries.
+func messageBytes(m interface{}) int {
+	switch m := m.(type) {
+	case *api.ProduceRequest:
+		return len(m.GetRecord().GetValue())
+	case *api.ConsumeResponse:
+		return len(m.GetRecord().GetValue())
+	}
+	return 0
+}
+
+func quotaExceeded(subject, action string, delay time.Duration) error {
+	msg := fmt.Sprintf("%s exceeded its %s quota, retry in %s", subject, action, delay)
+	st, err := status.New(codes.ResourceExhausted, msg).WithDetails(&errdetails.RetryInfo{
+		RetryDelay: durationpb.New(delay),
+	})
+	if err != nil {
+		return status.Error(codes.ResourceExhausted, msg)
+	}
+	return st.Err()
+}
@@ -0,0 +1,274 @@
+package server
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/soheilhy/cmux"
+	"go.uber.org/zap"
+
+	api "github.com/nireo/dilog/api/v1"
+)
+
+// SegmentProtocol is the first byte sent on connections speaking the segment
+// protocol, so they can share a port with gRPC and HTTP.
+//
+// The protocol ships sealed segment files without gRPC's framing, which lets
+// plaintext connections send them straight from the page cache with
+// sendfile. After the protocol byte, the client sends any number of
+// requests, one at a time:
+//
+//	base offset (8) | file (1) | position (8) | length (8)
+//
+// and the server answers each with a status byte, followed by the length of
+// the file's bytes (8) and the bytes themselves if it's segmentOK, or by the
+// length of an error message (4) and the message otherwise.
+const SegmentProtocol byte = 1
+
+const (
+	segmentRequestLen = 8 + 1 + 8 + 8
+
+	segmentOK    byte = 0
+	segmentError byte = 1
+)
+
+// ServeSegments serves the segment protocol on the listener's connections
+// until it's closed. Connections are authorized like the gRPC server's
+// consume calls.
+func ServeSegments(ln net.Listener, config *Config) error {
+	logger := zap.L().Named("segments")
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			defer conn.Close()
+			if err := serveSegmentConn(conn, config); err != nil && err != io.EOF {
+				logger.Debug("segment connection failed", zap.Error(err),
+					zap.String("peer", conn.RemoteAddr().String()))
+			}
+		}()
+	}
+}
+
+func serveSegmentConn(conn net.Conn, config *Config) error {
+	b := make([]byte, segmentRequestLen)
+	if _, err := io.ReadFull(conn, b[:1]); err != nil {
+		return err
+	}
+
+	if b[0] != SegmentProtocol {
+		return fmt.Errorf("unknown protocol: %d", b[0])
+	}
+
+	sub, err := connSubject(conn, config)
+	if err != nil {
+		return err
+	}
+
+	// writing to the underlying connection lets plaintext TCP connections use
+	// sendfile, which the mux's wrapper hides.
+	w := io.Writer(conn)
+	if mc, ok := conn.(*cmux.MuxConn); ok {
+		w = mc.Conn
+	}
+
+	for {
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return err
+		}
+
+		base := binary.BigEndian.Uint64(b[0:8])
+		file := api.SegmentFile(b[8])
+		pos := binary.BigEndian.Uint64(b[9:17])
+		length := binary.BigEndian.Uint64(b[17:25])
+
+		if err := serveSegment(w, config, sub, base, file, pos, length); err != nil {
+			return err
+		}
+	}
+}
+
+// serveSegment answers a single request. Errors about the request are sent
+// to the client, only errors writing to it are returned.
+func serveSegment(
+	w io.Writer,
+	config *Config,
+	sub string,
+	base uint64,
+	file api.SegmentFile,
+	pos, length uint64,
+) error {
+	r, err := openSegment(config, sub, base, file, pos, length)
+	if config.Audit != nil {
+		recordAudit(config.Audit, &api.AuditEntry{
+			Subject: sub,
+			Action:  consumeAction,
+			Object:  allLogsObject,
+			Method:  segmentMethod,
+		}, err)
+	}
+	if err != nil {
+		msg := []byte(err.Error())
+		header := make([]byte, 5)
+		header[0] = segmentError
+		binary.BigEndian.PutUint32(header[1:], uint32(len(msg)))
+		_, err = w.Write(append(header, msg...))
+		return err
+	}
+	defer r.Close()
+
+	header := make([]byte, 9)
+	header[0] = segmentOK
+	binary.BigEndian.PutUint64(header[1:], uint64(r.Len()))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	_, err = io.Copy(w, r)
+	return err
+}
+
+func openSegment(
+	config *Config,
+	sub string,
+	base uint64,
+	file api.SegmentFile,
+	pos, length uint64,
+) (segmentReader, error) {
+	if err := config.Authorizer.Authorize(sub, allLogsObject, consumeAction); err != nil {
+		return nil, err
+	}
+
+	segments, ok := config.CommitLog.(SegmentLog)
+	if !ok {
+		return nil, errors.New("log doesn't support segment transfer")
+	}
+
+	rc, err := segments.OpenSegment(base, file, pos, length)
+	if err != nil {
+		return nil, err
+	}
+
+	r, ok := rc.(segmentReader)
+	if !ok {
+		rc.Close()
+		return nil, errors.New("log doesn't report segment lengths")
+	}
+
+	return r, nil
+}
+
+// segmentReader is implemented by the readers of logs that know how many
+// bytes they'll read, which the protocol sends ahead of them.
+type segmentReader interface {
+	io.ReadCloser
+	Len() int64
+}
+
+// connSubject returns the identity of the connection's verified client
+// certificate, as the config's TLS authenticator finds it, or an empty
+// subject if the connection isn't TLS.
+func connSubject(conn net.Conn, config *Config) (string, error) {
+	if mc, ok := conn.(*cmux.MuxConn); ok {
+		conn = mc.Conn
+	}
+
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return "", nil
+	}
+
+	if err := tlsConn.Handshake(); err != nil {
+		return "", err
+	}
+
+	for _, authenticator := range config.authenticators() {
+		if tlsAuth, ok := authenticator.(TLSAuthenticator); ok {
+			return tlsAuth.AuthenticateTLS(tlsConn.ConnectionState())
+		}
+	}
+
+	return "", errors.New("no authenticator for client certificates")
+}
+
+// SegmentClient fetches sealed segment files over the segment protocol.
+type SegmentClient struct {
+	conn net.Conn
+}
+
+// DialSegments connects to the segment protocol served at addr, over TLS if
+// tlsConfig is set.
+func DialSegments(addr string, tlsConfig *tls.Config) (*SegmentClient, error) {
+	var (
+		conn net.Conn
+		err  error
+	)
+	if tlsConfig != nil {
+		conn, err = tls.Dial("tcp", addr, tlsConfig)
+	} else {
+		conn, err = net.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.Write([]byte{SegmentProtocol}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &SegmentClient{conn: conn}, nil
+}
+
+// Fetch copies length bytes of the segment's file starting at pos to w, or
+// the rest of the file if length is zero. It returns the number of bytes
+// copied.
+func (c *SegmentClient) Fetch(
+	base uint64,
+	file api.SegmentFile,
+	pos, length uint64,
+	w io.Writer,
+) (int64, error) {
+	req := make([]byte, segmentRequestLen)
+	binary.BigEndian.PutUint64(req[0:8], base)
+	req[8] = byte(file)
+	binary.BigEndian.PutUint64(req[9:17], pos)
+	binary.BigEndian.PutUint64(req[17:25], length)
+	if _, err := c.conn.Write(req); err != nil {
+		return 0, err
+	}
+
+	header := make([]byte, 9)
+	if _, err := io.ReadFull(c.conn, header[:1]); err != nil {
+		return 0, err
+	}
+
+	if header[0] != segmentOK {
+		if _, err := io.ReadFull(c.conn, header[1:5]); err != nil {
+			return 0, err
+		}
+
+		msg := make([]byte, binary.BigEndian.Uint32(header[1:5]))
+		if _, err := io.ReadFull(c.conn, msg); err != nil {
+			return 0, err
+		}
+		return 0, errors.New(string(msg))
+	}
+
+	if _, err := io.ReadFull(c.conn, header[1:]); err != nil {
+		return 0, err
+	}
+
+	return io.CopyN(w, c.conn, int64(binary.BigEndian.Uint64(header[1:])))
+}
+
+func (c *SegmentClient) Close() error {
+	return c.conn.Close()
+}
@@ -2,45 +2,158 @@ package server
 
 import (
 	"context"
-	"strings"
+	"crypto/tls"
+	"io"
+	"sync"
 	"time"
 
 	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
 	grpc_auth "github.com/grpc-ecosystem/go-grpc-middleware/auth"
 	grpc_ctxtags "github.com/grpc-ecosystem/go-grpc-middleware/tags"
 	api "github.com/nireo/dilog/api/v1"
+	"github.com/nireo/dilog/internal/auth"
+	"github.com/nireo/dilog/internal/log"
 	"go.opencensus.io/plugin/ocgrpc"
 	"go.opencensus.io/stats/view"
 	"go.opencensus.io/trace"
+	"go.opencensus.io/trace/propagation"
 
 	grpc_zap "github.com/grpc-ecosystem/go-grpc-middleware/logging/zap"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/credentials"
-	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
 )
 
 const (
-	objectWildcard = "*"
+	segmentChunkSize = 64 * 1024
+
+	// Records are authorized against the log they belong to, logs/<log>.
+	// Offsets span every log, so reading by offset without naming a log is
+	// authorized against all of them.
+	logObjectPrefix   = "logs/"
+	allLogsObject     = logObjectPrefix + "*"
+	replicationObject = "replication"
+	clusterObject     = "cluster"
+	gossipObject      = "gossip"
+	aclObject         = "acl"
+	auditObject       = "audit"
+
 	produceAction  = "produce"
 	consumeAction  = "consume"
+	describeAction = "describe"
+	adminAction    = "admin"
+	deleteAction   = "delete"
+	truncateAction = "truncate"
+
+	defaultDecommissionTimeout = 30 * time.Second
 )
 
+// errNotInLog is returned when consuming a record of another log than the
+// one asked for.
+var errNotInLog = status.Error(codes.NotFound, "record isn't in the requested log")
+
+// Authenticator finds out who sent a request. ok is false if the request
+// doesn't carry the kind of credentials it checks, while invalid credentials
+// are an error.
+type Authenticator interface {
+	Authenticate(ctx context.Context) (subject string, ok bool, err error)
+}
+
+// TLSAuthenticator is implemented by authenticators that can find out who
+// opened a TLS connection, which authenticates the segment protocol.
+type TLSAuthenticator interface {
+	AuthenticateTLS(state tls.ConnectionState) (subject string, err error)
+}
+
 type Authorizer interface {
 	Authorize(subject, object, action string) error
 }
 
+// PolicyReloader is implemented by authorizers that can reload their
+// policy while running.
+type PolicyReloader interface {
+	// Reload swaps in the policy from its source, keeping the current one
+	// if the new one is invalid. The actor is logged along with the result.
+	Reload(actor string) (rules int, err error)
+}
+
 type CommitLog interface {
 	Append(*api.Record) (uint64, error)
 	Read(uint64) (*api.Record, error)
 }
 
+// SegmentLog is implemented by commit logs that can ship their sealed
+// segments as raw bytes.
+type SegmentLog interface {
+	Segments() []*api.SegmentInfo
+	OpenSegment(base uint64, file api.SegmentFile, pos, length uint64) (io.ReadCloser, error)
+}
+
+// OffsetLog is implemented by commit logs that can report their offsets.
+type OffsetLog interface {
+	LowestOffset() (uint64, error)
+	NextOffset() (uint64, error)
+}
+
+// TruncatableLog is implemented by commit logs that can remove their old
+// segments.
+type TruncatableLog interface {
+	Truncate(lowest uint64) error
+}
+
+// ReplicationStatuser reports how replication from each peer is going.
+type ReplicationStatuser interface {
+	Status() []*api.PeerReplicationStatus
+}
+
+// Repairer is implemented by replicators that restore the replicas lost
+// when a node fails.
+type Repairer interface {
+	Repairs() []*api.Repair
+}
+
+// Decommissioner drains the node so it can be removed from the cluster.
+type Decommissioner interface {
+	// Decommission stops the node from taking produces, waits for its peers
+	// to replicate its log and then leaves the cluster.
+	Decommission(ctx context.Context) (nextOffset uint64, err error)
+	Decommissioning() bool
+}
+
+// Cluster describes the cluster the node is a member of.
+type Cluster interface {
+	Topology() []*api.Node
+	// Placements returns where each node's log is replicated.
+	Placements() []*api.Placement
+}
+
+// GossipKeyring manages the keys the cluster's gossip is encrypted with.
+type GossipKeyring interface {
+	GossipKeys(op api.GossipKeyOp, key string) (*api.GossipKeysResponse, error)
+}
+
 type Config struct {
 	CommitLog  CommitLog
 	Authorizer Authorizer
+	// Audit records the authorized calls, including the denied ones, if
+	// set.
+	Audit AuditLog
+	// Quotas limits how fast each subject may produce and consume, if set.
+	Quotas Quotas
+	// Authenticators are tried in order and the first one that finds
+	// credentials sets the request's subject, requests without any get an
+	// empty subject. Defaults to authenticating client certificates.
+	Authenticators []Authenticator
+	Replication    ReplicationStatuser
+	Decommissioner Decommissioner
+	Cluster        Cluster
+	GossipKeyring  GossipKeyring
+	// NodeName is recorded as the origin of records produced by clients.
+	// Records with an origin of their own are only taken from subjects
+	// allowed to produce to the replication object.
+	NodeName string
 }
 
 var _ api.LogServer = (*grpcServer)(nil)
@@ -48,6 +161,10 @@ var _ api.LogServer = (*grpcServer)(nil)
 type grpcServer struct {
 	api.UnimplementedLogServer
 	*Config
+
+	// produceMu serializes appends, so that a record produced here knows
+	// its offset before it's appended.
+	produceMu sync.Mutex
 }
 
 func newgrpcServer(config *Config) (srv *grpcServer, err error) {
@@ -59,20 +176,72 @@ func newgrpcServer(config *Config) (srv *grpcServer, err error) {
 }
 
 func (s *grpcServer) Produce(ctx context.Context, req *api.ProduceRequest) (*api.ProduceResponse, error) {
-	if err := s.Authorizer.Authorize(subject(ctx), objectWildcard, produceAction); err != nil {
+	// a record's origin decides whether replicators apply it, so only they
+	// may produce records that originated on another node. The origin of
+	// the rest is filled in when they're appended.
+	replicated := req.Record.Origin != "" || req.Record.OriginOffset != 0
+	if !replicated && req.Record.Log == "" {
+		req.Record.Log = s.NodeName
+	}
+
+	object := logObject(req.Record.Log)
+	if replicated {
+		object = replicationObject
+	}
+
+	if err := s.authorize(ctx, object, produceAction); err != nil {
 		return nil, err
 	}
 
-	offset, err := s.CommitLog.Append(req.Record)
+	if s.Decommissioner != nil && s.Decommissioner.Decommissioning() {
+		return nil, status.Error(codes.Unavailable, "node is being decommissioned")
+	}
+
+	// records keep the context of the call that first produced them, so
+	// replicated records are linked to it rather than to the replicator's
+	// produces.
+	if span := trace.FromContext(ctx); span != nil && len(req.Record.TraceContext) == 0 {
+		if sc := span.SpanContext(); sc.IsSampled() {
+			req.Record.TraceContext = propagation.Binary(sc)
+		}
+	}
+
+	offset, err := s.append(req.Record, !replicated)
 	if err != nil {
 		return nil, err
 	}
+	auditOffsets(ctx, offset, offset)
 
 	return &api.ProduceResponse{Offset: offset}, nil
 }
 
-func (s grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (*api.ConsumeResponse, error) {
-	if err := s.Authorizer.Authorize(subject(ctx), objectWildcard, consumeAction); err != nil {
+// append appends the record, recording it as originating here at the offset
+// it's given if it's local.
+func (s *grpcServer) append(record *api.Record, local bool) (uint64, error) {
+	s.produceMu.Lock()
+	defer s.produceMu.Unlock()
+
+	if local {
+		record.Origin = s.NodeName
+		if offsets, ok := s.CommitLog.(OffsetLog); ok {
+			next, err := offsets.NextOffset()
+			if err != nil {
+				return 0, err
+			}
+			record.OriginOffset = next
+		}
+	}
+
+	return s.CommitLog.Append(record)
+}
+
+func (s *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (*api.ConsumeResponse, error) {
+	object := allLogsObject
+	if req.Log != "" {
+		object = logObject(req.Log)
+	}
+
+	if err := s.authorize(ctx, object, consumeAction); err != nil {
 		return nil, err
 	}
 
@@ -81,6 +250,11 @@ func (s grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (*api.
 		return nil, err
 	}
 
+	if req.Log != "" && record.Log != req.Log {
+		return nil, errNotInLog
+	}
+	auditOffsets(ctx, record.Offset, record.Offset)
+
 	return &api.ConsumeResponse{Record: record}, nil
 }
 
@@ -109,9 +283,19 @@ func (s *grpcServer) ConsumeStream(req *api.ConsumeRequest, stream api.Log_Consu
 			return nil
 		default:
 			res, err := s.Consume(stream.Context(), req)
+			if err == errNotInLog {
+				req.Offset++
+				continue
+			}
+
 			switch err.(type) {
 			case nil:
 			case api.ErrOffsetOutOfRange:
+				// reads past the end wait for the record to be appended,
+				// but records below the lowest offset never will be.
+				if err := s.truncated(req.Offset); err != nil {
+					return err
+				}
 				continue
 			default:
 				return err
@@ -126,6 +310,282 @@ func (s *grpcServer) ConsumeStream(req *api.ConsumeRequest, stream api.Log_Consu
 	}
 }
 
+// truncated returns ErrOffsetTruncated if the log has been truncated past the
+// offset.
+func (s *grpcServer) truncated(off uint64) error {
+	offsets, ok := s.CommitLog.(OffsetLog)
+	if !ok {
+		return nil
+	}
+
+	lowest, err := offsets.LowestOffset()
+	if err != nil {
+		return err
+	}
+
+	if off < lowest {
+		return api.ErrOffsetTruncated{Offset: off, LowestOffset: lowest}
+	}
+
+	return nil
+}
+
+// ListSegments and FetchSegment ship segments as they are, holding the
+// records of every log, so they need permission to consume every log.
+func (s *grpcServer) ListSegments(ctx context.Context, req *api.ListSegmentsRequest) (*api.ListSegmentsResponse, error) {
+	if err := s.authorize(ctx, allLogsObject, consumeAction); err != nil {
+		return nil, err
+	}
+
+	segments, ok := s.CommitLog.(SegmentLog)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "log doesn't support segment transfer")
+	}
+
+	return &api.ListSegmentsResponse{Segments: segments.Segments()}, nil
+}
+
+func (s *grpcServer) FetchSegment(req *api.FetchSegmentRequest, stream api.Log_FetchSegmentServer) error {
+	if err := s.authorize(stream.Context(), allLogsObject, consumeAction); err != nil {
+		return err
+	}
+
+	segments, ok := s.CommitLog.(SegmentLog)
+	if !ok {
+		return status.Error(codes.Unimplemented, "log doesn't support segment transfer")
+	}
+
+	r, err := segments.OpenSegment(req.BaseOffset, req.File, req.Position, req.Length)
+	switch err {
+	case nil:
+	case log.ErrSegmentNotFound:
+		return status.Error(codes.NotFound, err.Error())
+	case log.ErrSegmentNotSealed:
+		return status.Error(codes.FailedPrecondition, err.Error())
+	default:
+		return err
+	}
+	defer r.Close()
+
+	buf := make([]byte, segmentChunkSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if err := stream.Send(&api.FetchSegmentResponse{Data: buf[:n]}); err != nil {
+				return err
+			}
+		}
+
+		switch err {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			return nil
+		default:
+			return err
+		}
+	}
+}
+
+func (s *grpcServer) GetOffsets(ctx context.Context, req *api.GetOffsetsRequest) (*api.GetOffsetsResponse, error) {
+	if err := s.authorize(ctx, allLogsObject, describeAction); err != nil {
+		return nil, err
+	}
+
+	offsets, ok := s.CommitLog.(OffsetLog)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "log doesn't support reporting offsets")
+	}
+
+	lowest, err := offsets.LowestOffset()
+	if err != nil {
+		return nil, err
+	}
+
+	next, err := offsets.NextOffset()
+	if err != nil {
+		return nil, err
+	}
+
+	return &api.GetOffsetsResponse{LowestOffset: lowest, NextOffset: next}, nil
+}
+
+func (s *grpcServer) ReplicationStatus(ctx context.Context, req *api.ReplicationStatusRequest) (*api.ReplicationStatusResponse, error) {
+	if err := s.authorize(ctx, replicationObject, describeAction); err != nil {
+		return nil, err
+	}
+
+	if s.Replication == nil {
+		return nil, status.Error(codes.Unimplemented, "replication isn't enabled")
+	}
+
+	return &api.ReplicationStatusResponse{Peers: s.Replication.Status()}, nil
+}
+
+func (s *grpcServer) RepairStatus(ctx context.Context, req *api.RepairStatusRequest) (*api.RepairStatusResponse, error) {
+	if err := s.authorize(ctx, replicationObject, describeAction); err != nil {
+		return nil, err
+	}
+
+	repairer, ok := s.Replication.(Repairer)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "replication doesn't support repairs")
+	}
+
+	return &api.RepairStatusResponse{Repairs: repairer.Repairs()}, nil
+}
+
+func (s *grpcServer) Decommission(ctx context.Context, req *api.DecommissionRequest) (*api.DecommissionResponse, error) {
+	if err := s.authorize(ctx, clusterObject, adminAction); err != nil {
+		return nil, err
+	}
+
+	if s.Decommissioner == nil {
+		return nil, status.Error(codes.Unimplemented, "decommissioning isn't supported")
+	}
+
+	timeout := defaultDecommissionTimeout
+	if req.TimeoutMs != 0 {
+		timeout = time.Duration(req.TimeoutMs) * time.Millisecond
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	next, err := s.Decommissioner.Decommission(ctx)
+	if err == context.DeadlineExceeded {
+		return nil, status.Error(codes.DeadlineExceeded, "timed out waiting for peers to catch up")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &api.DecommissionResponse{NextOffset: next}, nil
+}
+
+func (s *grpcServer) Topology(ctx context.Context, req *api.TopologyRequest) (*api.TopologyResponse, error) {
+	if err := s.authorize(ctx, clusterObject, describeAction); err != nil {
+		return nil, err
+	}
+
+	if s.Cluster == nil {
+		return nil, status.Error(codes.Unimplemented, "node isn't part of a cluster")
+	}
+
+	return &api.TopologyResponse{
+		Nodes:      s.Cluster.Topology(),
+		Placements: s.Cluster.Placements(),
+	}, nil
+}
+
+func (s *grpcServer) GossipKeys(ctx context.Context, req *api.GossipKeysRequest) (*api.GossipKeysResponse, error) {
+	if err := s.authorize(ctx, gossipObject, gossipKeyAction(req.Op)); err != nil {
+		return nil, err
+	}
+
+	if s.GossipKeyring == nil {
+		return nil, status.Error(codes.Unimplemented, "gossip encryption isn't supported")
+	}
+
+	if req.Op != api.GossipKeyOp_LIST_KEYS && req.Key == "" {
+		return nil, status.Error(codes.InvalidArgument, "key is required")
+	}
+
+	return s.GossipKeyring.GossipKeys(req.Op, req.Key)
+}
+
+func (s *grpcServer) ReloadACL(ctx context.Context, req *api.ReloadACLRequest) (*api.ReloadACLResponse, error) {
+	if err := s.authorize(ctx, aclObject, adminAction); err != nil {
+		return nil, err
+	}
+
+	reloader, ok := s.Authorizer.(PolicyReloader)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "authorizer doesn't support reloading")
+	}
+
+	rules, err := reloader.Reload(subject(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	return &api.ReloadACLResponse{Rules: uint32(rules)}, nil
+}
+
+func (s *grpcServer) Truncate(ctx context.Context, req *api.TruncateRequest) (*api.TruncateResponse, error) {
+	if err := s.authorize(ctx, allLogsObject, truncateAction); err != nil {
+		return nil, err
+	}
+
+	truncatable, ok := s.CommitLog.(TruncatableLog)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "log doesn't support truncating")
+	}
+
+	offsets, ok := s.CommitLog.(OffsetLog)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "log doesn't support reporting offsets")
+	}
+
+	next, err := offsets.NextOffset()
+	if err != nil {
+		return nil, err
+	}
+
+	// the log's Truncate removes the segments whose records are all at or
+	// below the offset it's given, so it's given the one below the lowest to
+	// keep. That would take the active segment too once the lowest reaches
+	// the next offset, so the lowest is capped below it.
+	if lowest := req.LowestOffset; lowest > 0 && next > 0 {
+		if lowest >= next {
+			lowest = next - 1
+		}
+		if lowest > 0 {
+			if err := truncatable.Truncate(lowest - 1); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	lowest, err := offsets.LowestOffset()
+	if err != nil {
+		return nil, err
+	}
+
+	return &api.TruncateResponse{LowestOffset: lowest}, nil
+}
+
+func (s *grpcServer) QueryAudit(ctx context.Context, req *api.QueryAuditRequest) (*api.QueryAuditResponse, error) {
+	if err := s.authorize(ctx, auditObject, adminAction); err != nil {
+		return nil, err
+	}
+
+	querier, ok := s.Audit.(AuditQuerier)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "audit log isn't queryable")
+	}
+
+	return querier.Query(req)
+}
+
+// logObject returns the object producing to and consuming from the log are
+// authorized against.
+func logObject(log string) string {
+	return logObjectPrefix + log
+}
+
+// gossipKeyAction returns the action a gossip key operation is authorized
+// as. Listing only describes the keyring while removing a key deletes it.
+func gossipKeyAction(op api.GossipKeyOp) string {
+	switch op {
+	case api.GossipKeyOp_LIST_KEYS:
+		return describeAction
+	case api.GossipKeyOp_REMOVE_KEY:
+		return deleteAction
+	default:
+		return adminAction
+	}
+}
+
 func NewGRPCServer(config *Config, opts ...grpc.ServerOption) (*grpc.Server, error) {
 	logger := zap.L().Named("server")
 	zapOpts := []grpc_zap.Option{
@@ -136,30 +596,23 @@ func NewGRPCServer(config *Config, opts ...grpc.ServerOption) (*grpc.Server, err
 		),
 	}
 
-	trace.ApplyConfig(trace.Config{DefaultSampler: trace.AlwaysSample()})
 	if err := view.Register(ocgrpc.DefaultServerViews...); err != nil {
 		return nil, err
 	}
 
-	halfSampler := trace.ProbabilitySampler(0.5)
-	trace.ApplyConfig(trace.Config{
-		DefaultSampler: func(p trace.SamplingParameters) trace.SamplingDecision {
-			if strings.Contains(p.Name, "Produce") {
-				return trace.SamplingDecision{Sample: true}
-			}
-			return halfSampler(p)
-		},
-	})
-
 	opts = append(opts, grpc.StreamInterceptor(
 		grpc_middleware.ChainStreamServer(
 			grpc_ctxtags.StreamServerInterceptor(),
 			grpc_zap.StreamServerInterceptor(logger, zapOpts...),
-			grpc_auth.StreamServerInterceptor(authenticate),
+			grpc_auth.StreamServerInterceptor(authenticate(config)),
+			quotaStreamInterceptor(config),
+			auditStreamInterceptor(config),
 		)), grpc.UnaryInterceptor(grpc_middleware.ChainUnaryServer(
 		grpc_ctxtags.UnaryServerInterceptor(),
 		grpc_zap.UnaryServerInterceptor(logger, zapOpts...),
-		grpc_auth.UnaryServerInterceptor(authenticate),
+		grpc_auth.UnaryServerInterceptor(authenticate(config)),
+		quotaUnaryInterceptor(config),
+		auditUnaryInterceptor(config),
 	)),
 		grpc.StatsHandler(&ocgrpc.ServerHandler{}),
 	)
@@ -174,21 +627,31 @@ func NewGRPCServer(config *Config, opts ...grpc.ServerOption) (*grpc.Server, err
 	return gsrv, nil
 }
 
-func authenticate(ctx context.Context) (context.Context, error) {
-	peer, ok := peer.FromContext(ctx)
-	if !ok {
-		return ctx, status.New(codes.Unknown, "couldn't find peer info").Err()
-	}
+// authenticate sets the subject of each request to the one the first of the
+// config's authenticators finds.
+func authenticate(config *Config) grpc_auth.AuthFunc {
+	authenticators := config.authenticators()
+	return func(ctx context.Context) (context.Context, error) {
+		for _, authenticator := range authenticators {
+			subject, ok, err := authenticator.Authenticate(ctx)
+			if err != nil {
+				return ctx, err
+			}
+
+			if ok {
+				return context.WithValue(ctx, subjectContextKey{}, subject), nil
+			}
+		}
 
-	if peer.AuthInfo == nil {
 		return context.WithValue(ctx, subjectContextKey{}, ""), nil
 	}
+}
 
-	tlsInfo := peer.AuthInfo.(credentials.TLSInfo)
-	subject := tlsInfo.State.VerifiedChains[0][0].Subject.CommonName
-	ctx = context.WithValue(ctx, subjectContextKey{}, subject)
-
-	return ctx, nil
+func (c *Config) authenticators() []Authenticator {
+	if len(c.Authenticators) == 0 {
+		return []Authenticator{auth.MTLS{}}
+	}
+	return c.Authenticators
 }
 
 func subject(ctx context.Context) string {
@@ -3,23 +3,40 @@ package server
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
 	"flag"
+	"fmt"
 	"io/ioutil"
+	"math"
 	"net"
+	"net/url"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	api "github.com/nireo/dilog/api/v1"
+	"github.com/nireo/dilog/internal/audit"
 	"github.com/nireo/dilog/internal/auth"
 	"github.com/nireo/dilog/internal/config"
 	"github.com/nireo/dilog/internal/log"
+	"github.com/nireo/dilog/internal/quota"
 	"go.opencensus.io/examples/exporter"
 	"go.uber.org/zap"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
 )
 
 var debug = flag.Bool("debug", false, "enable observability for debugging.")
@@ -49,6 +66,7 @@ func TestServer(t *testing.T) {
 		"produce/consume stream succeeds":                    testProduceConsumeStream,
 		"consume past log boundary fails":                    testConsumePastBoundary,
 		"unauthorized fails":                                 testUnauthorized,
+		"segment transfer succeeds":                          testSegmentTransfer,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			rootClient, nobodyClient, config, teardown := setupTests(t, nil)
@@ -341,3 +359,861 @@ func testUnauthorized(t *testing.T, _, client api.LogClient, config *Config) {
 		t.Fatalf("got code: %d, want: %d", gotCode, wantCode)
 	}
 }
+
+func testSegmentTransfer(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+
+	// produce enough records for the first segments to be sealed.
+	for i := 0; i < 100; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{
+				Value: []byte(fmt.Sprintf("message %d", i)),
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "segment-transfer-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	n, err := log.Download(ctx, client, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n == 0 {
+		t.Fatal("no segments were downloaded")
+	}
+
+	replica, err := log.NewLog(dir, log.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replica.Close()
+
+	highest, err := replica.HighestOffset()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for off := uint64(0); off <= highest; off++ {
+		want, err := config.CommitLog.Read(off)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := replica.Read(off)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(want.Value, got.Value) {
+			t.Fatalf("got value: %q, want: %q", got.Value, want.Value)
+		}
+	}
+}
+
+func TestAuthorization(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authorization-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// nobody may only produce to and consume from the orders log and
+	// describe things.
+	policy := filepath.Join(dir, "policy.csv")
+	rules := []byte(`p, admin, *, *
+p, producer, logs/orders, produce
+p, producer, logs/orders, consume
+p, operator, *, describe
+g, root, admin
+g, nobody, producer
+g, nobody, operator
+`)
+	if err := ioutil.WriteFile(policy, rules, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	rootClient, nobodyClient, _, teardown := setupTests(t, func(c *Config) {
+		c.Authorizer = auth.New(config.ACLModelFile, policy)
+	})
+	defer teardown()
+
+	ctx := context.Background()
+	produce := func(client api.LogClient, log, origin string) (uint64, error) {
+		res, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{
+				Value:  []byte("hello world"),
+				Log:    log,
+				Origin: origin,
+			},
+		})
+		if err != nil {
+			return 0, err
+		}
+		return res.Offset, nil
+	}
+
+	orders, err := produce(rootClient, "orders", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payments, err := produce(rootClient, "payments", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	consume := func(log string, offset uint64) error {
+		_, err := nobodyClient.Consume(ctx, &api.ConsumeRequest{Offset: offset, Log: log})
+		return err
+	}
+
+	for scenario, tc := range map[string]struct {
+		call func() error
+		want codes.Code
+	}{
+		"produce to a permitted log": {
+			call: func() error {
+				_, err := produce(nobodyClient, "orders", "")
+				return err
+			},
+			want: codes.OK,
+		},
+		"produce to another log": {
+			call: func() error {
+				_, err := produce(nobodyClient, "payments", "")
+				return err
+			},
+			want: codes.PermissionDenied,
+		},
+		"produce a record from another node": {
+			call: func() error {
+				_, err := produce(nobodyClient, "orders", "payments")
+				return err
+			},
+			want: codes.PermissionDenied,
+		},
+		"consume from a permitted log": {
+			call: func() error { return consume("orders", orders) },
+			want: codes.OK,
+		},
+		"consume another log's record through a permitted log": {
+			call: func() error { return consume("orders", payments) },
+			want: codes.NotFound,
+		},
+		"consume from another log": {
+			call: func() error { return consume("payments", payments) },
+			want: codes.PermissionDenied,
+		},
+		"consume from every log": {
+			call: func() error { return consume("", orders) },
+			want: codes.PermissionDenied,
+		},
+		"describe offsets": {
+			call: func() error {
+				_, err := nobodyClient.GetOffsets(ctx, &api.GetOffsetsRequest{})
+				return err
+			},
+			want: codes.OK,
+		},
+		"list gossip keys": {
+			call: func() error {
+				_, err := nobodyClient.GossipKeys(ctx, &api.GossipKeysRequest{
+					Op: api.GossipKeyOp_LIST_KEYS,
+				})
+				return err
+			},
+			// authorized, but the server has no keyring.
+			want: codes.Unimplemented,
+		},
+		"remove gossip key": {
+			call: func() error {
+				_, err := nobodyClient.GossipKeys(ctx, &api.GossipKeysRequest{
+					Op:  api.GossipKeyOp_REMOVE_KEY,
+					Key: "key",
+				})
+				return err
+			},
+			want: codes.PermissionDenied,
+		},
+		"truncate without permission": {
+			call: func() error {
+				_, err := nobodyClient.Truncate(ctx, &api.TruncateRequest{})
+				return err
+			},
+			want: codes.PermissionDenied,
+		},
+		"truncate as admin": {
+			call: func() error {
+				_, err := rootClient.Truncate(ctx, &api.TruncateRequest{})
+				return err
+			},
+			want: codes.OK,
+		},
+		"reload acl without permission": {
+			call: func() error {
+				_, err := nobodyClient.ReloadACL(ctx, &api.ReloadACLRequest{})
+				return err
+			},
+			want: codes.PermissionDenied,
+		},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			if got := status.Code(tc.call()); got != tc.want {
+				t.Fatalf("got code: %s, want: %s", got, tc.want)
+			}
+		})
+	}
+
+	// streaming a log skips the other logs' records.
+	stream, err := nobodyClient.ConsumeStream(ctx, &api.ConsumeRequest{Log: "orders"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []uint64{orders, payments + 1} {
+		res, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if res.Record.Log != "orders" || res.Record.Offset < want {
+			t.Fatalf("got record %d of log %s", res.Record.Offset, res.Record.Log)
+		}
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	rootClient, _, _, teardown := setupTests(t, nil)
+	defer teardown()
+
+	ctx := context.Background()
+	var segments *api.ListSegmentsResponse
+	for len(segments.GetSegments()) < 3 {
+		_, err := rootClient.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: bytes.Repeat([]byte{'a'}, 128)},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		segments, err = rootClient.ListSegments(ctx, &api.ListSegmentsRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	first := segments.Segments[0]
+
+	truncate := func(lowest, want uint64) {
+		t.Helper()
+
+		res, err := rootClient.Truncate(ctx, &api.TruncateRequest{LowestOffset: lowest})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if res.LowestOffset != want {
+			t.Fatalf("got lowest offset: %d, want: %d", res.LowestOffset, want)
+		}
+
+		if _, err := rootClient.Consume(ctx, &api.ConsumeRequest{Offset: lowest}); err != nil {
+			t.Fatalf("couldn't consume the lowest offset: %v", err)
+		}
+	}
+
+	// the first segment holds the lowest offset, so nothing goes.
+	truncate(first.NextOffset-1, first.BaseOffset)
+	// once it's past the first segment, the first segment goes.
+	truncate(first.NextOffset, first.NextOffset)
+
+	// the active segment is kept however high the lowest offset is, so the
+	// log can still be appended to.
+	if _, err := rootClient.Truncate(ctx, &api.TruncateRequest{LowestOffset: math.MaxUint64}); err != nil {
+		t.Fatal(err)
+	}
+
+	produce, err := rootClient.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("after truncating")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := rootClient.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offset}); err != nil {
+		t.Fatalf("couldn't consume after truncating: %v", err)
+	}
+}
+
+// gatedLog holds reads of its offset until the gate is closed.
+type gatedLog struct {
+	*log.Log
+	offset uint64
+	gate   chan struct{}
+}
+
+func (l *gatedLog) Read(off uint64) (*api.Record, error) {
+	if off == l.offset {
+		<-l.gate
+	}
+	return l.Log.Read(off)
+}
+
+func TestTruncateConsumeStream(t *testing.T) {
+	gated := &gatedLog{offset: 1, gate: make(chan struct{})}
+	rootClient, _, _, teardown := setupTests(t, func(c *Config) {
+		gated.Log = c.CommitLog.(*log.Log)
+		c.CommitLog = gated
+	})
+	defer teardown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var segments *api.ListSegmentsResponse
+	for len(segments.GetSegments()) < 3 {
+		_, err := rootClient.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: bytes.Repeat([]byte{'a'}, 128)},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		segments, err = rootClient.ListSegments(ctx, &api.ListSegmentsRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	lowest := segments.Segments[0].NextOffset
+
+	stream, err := rootClient.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := stream.Recv(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the log is truncated past the next offset while the stream reads it.
+	res, err := rootClient.Truncate(ctx, &api.TruncateRequest{LowestOffset: lowest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.LowestOffset != lowest {
+		t.Fatalf("got lowest offset: %d, want: %d", res.LowestOffset, lowest)
+	}
+	close(gated.gate)
+
+	// the stream fails instead of waiting for records that won't come.
+	_, err = stream.Recv()
+	if got, want := status.Code(err), codes.OutOfRange; got != want {
+		t.Fatalf("got code: %v, want: %v", got, want)
+	}
+
+	// and so do streams started below the lowest offset.
+	stream, err = rootClient.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = stream.Recv()
+	if got, want := status.Code(err), codes.OutOfRange; got != want {
+		t.Fatalf("got code: %v, want: %v", got, want)
+	}
+}
+
+func TestOrigins(t *testing.T) {
+	dir, err := ioutil.TempDir("", "origins-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// nobody may produce, but not replicate.
+	policy := filepath.Join(dir, "policy.csv")
+	rules := []byte(`p, admin, *, *
+p, producer, logs/*, produce
+g, root, admin
+g, nobody, producer
+`)
+	if err := ioutil.WriteFile(policy, rules, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	rootClient, nobodyClient, _, teardown := setupTests(t, func(c *Config) {
+		c.Authorizer = auth.New(config.ACLModelFile, policy)
+		c.NodeName = "local"
+	})
+	defer teardown()
+
+	ctx := context.Background()
+	for scenario, tc := range map[string]struct {
+		client api.LogClient
+		record *api.Record
+		want   codes.Code
+		// wantOrigin and wantOriginOffset are what the record is stored
+		// with, wantOriginOffset is relative to the record's offset for
+		// local records.
+		wantOrigin       string
+		wantOriginOffset uint64
+		local            bool
+	}{
+		"local record": {
+			client:     nobodyClient,
+			record:     &api.Record{Value: []byte("hello")},
+			wantOrigin: "local",
+			local:      true,
+		},
+		"forged origin": {
+			client: nobodyClient,
+			record: &api.Record{Value: []byte("hello"), Origin: "other", OriginOffset: 5},
+			want:   codes.PermissionDenied,
+		},
+		"forged origin offset": {
+			client: nobodyClient,
+			record: &api.Record{Value: []byte("hello"), OriginOffset: 5},
+			want:   codes.PermissionDenied,
+		},
+		"replicated record": {
+			client:           rootClient,
+			record:           &api.Record{Value: []byte("hello"), Origin: "other", OriginOffset: 5},
+			wantOrigin:       "other",
+			wantOriginOffset: 5,
+		},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			produce, err := tc.client.Produce(ctx, &api.ProduceRequest{Record: tc.record})
+			if got := status.Code(err); got != tc.want {
+				t.Fatalf("got code: %s, want: %s", got, tc.want)
+			}
+			if err != nil {
+				return
+			}
+
+			consume, err := rootClient.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offset})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := tc.wantOriginOffset
+			if tc.local {
+				want = produce.Offset
+			}
+
+			got := consume.Record
+			if got.Origin != tc.wantOrigin || got.OriginOffset != want {
+				t.Fatalf(
+					"got origin: %s@%d, want: %s@%d",
+					got.Origin, got.OriginOffset, tc.wantOrigin, want,
+				)
+			}
+		})
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authentication-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwks, err := json.Marshal(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{
+		Key:       key.Public(),
+		KeyID:     "test",
+		Algorithm: string(jose.RS256),
+		Use:       "sig",
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwksFile := filepath.Join(dir, "jwks.json")
+	if err := ioutil.WriteFile(jwksFile, jwks, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	jwtAuth, err := auth.NewJWT(auth.JWTConfig{
+		JWKSFile: jwksFile,
+		Issuer:   "dilog-test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the nobody client's certificate is the fallback when the request has
+	// no token or key.
+	_, nobodyClient, _, teardown := setupTests(t, func(c *Config) {
+		c.Authenticators = []Authenticator{
+			jwtAuth,
+			auth.NewAPIKeys(map[string]string{"secret": "root"}),
+			auth.MTLS{},
+		}
+	})
+	defer teardown()
+
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.RS256, Key: key},
+		(&jose.SignerOptions{}).WithHeader("kid", "test"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a zero expiry leaves the token without one.
+	token := func(issuer string, expiry time.Time) string {
+		claims := jwt.Claims{
+			Subject: "root",
+			Issuer:  issuer,
+		}
+		if !expiry.IsZero() {
+			claims.Expiry = jwt.NewNumericDate(expiry)
+		}
+
+		raw, err := jwt.Signed(signer).Claims(claims).CompactSerialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return raw
+	}
+
+	for scenario, tc := range map[string]struct {
+		md   []string
+		want codes.Code
+	}{
+		"valid bearer token": {
+			md:   []string{auth.AuthorizationHeader, "Bearer " + token("dilog-test", time.Now().Add(time.Hour))},
+			want: codes.OK,
+		},
+		"expired bearer token": {
+			md:   []string{auth.AuthorizationHeader, "Bearer " + token("dilog-test", time.Now().Add(-time.Hour))},
+			want: codes.Unauthenticated,
+		},
+		"bearer token without expiry": {
+			md:   []string{auth.AuthorizationHeader, "Bearer " + token("dilog-test", time.Time{})},
+			want: codes.Unauthenticated,
+		},
+		"bearer token from another issuer": {
+			md:   []string{auth.AuthorizationHeader, "Bearer " + token("someone-else", time.Now().Add(time.Hour))},
+			want: codes.Unauthenticated,
+		},
+		"valid api key": {
+			md:   []string{auth.APIKeyHeader, "secret"},
+			want: codes.OK,
+		},
+		"unknown api key": {
+			md:   []string{auth.APIKeyHeader, "guess"},
+			want: codes.Unauthenticated,
+		},
+		"client certificate": {
+			want: codes.PermissionDenied,
+		},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			ctx := metadata.AppendToOutgoingContext(context.Background(), tc.md...)
+			_, err := nobodyClient.Produce(ctx, &api.ProduceRequest{
+				Record: &api.Record{Value: []byte("hello world")},
+			})
+			if got := status.Code(err); got != tc.want {
+				t.Fatalf("got code: %s, want: %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCertificateIdentity(t *testing.T) {
+	spiffeID, err := url.Parse("spiffe://example.org/ns/prod/sa/producer")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert := &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "producer"},
+		DNSNames: []string{"producer.example.org"},
+		URIs:     []*url.URL{spiffeID},
+	}
+
+	withTLS := func(chains [][]*x509.Certificate) context.Context {
+		return peer.NewContext(context.Background(), &peer.Peer{
+			AuthInfo: credentials.TLSInfo{
+				State: tls.ConnectionState{VerifiedChains: chains},
+			},
+		})
+	}
+	verified := withTLS([][]*x509.Certificate{{cert}})
+
+	for scenario, tc := range map[string]struct {
+		mtls        auth.MTLS
+		ctx         context.Context
+		wantSubject string
+		wantCode    codes.Code
+	}{
+		"common name": {
+			ctx:         verified,
+			wantSubject: "producer",
+		},
+		"dns name": {
+			mtls:        auth.MTLS{Identity: auth.IdentityDNSName},
+			ctx:         verified,
+			wantSubject: "producer.example.org",
+		},
+		"spiffe id": {
+			mtls:        auth.MTLS{Identity: auth.IdentitySPIFFE, TrustDomain: "example.org"},
+			ctx:         verified,
+			wantSubject: "spiffe://example.org/ns/prod/sa/producer",
+		},
+		"spiffe id from another trust domain": {
+			mtls:     auth.MTLS{Identity: auth.IdentitySPIFFE, TrustDomain: "example.com"},
+			ctx:      verified,
+			wantCode: codes.Unauthenticated,
+		},
+		"missing spiffe id": {
+			mtls:     auth.MTLS{Identity: auth.IdentitySPIFFE},
+			ctx:      withTLS([][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "producer"}}}}),
+			wantCode: codes.Unauthenticated,
+		},
+		"unverified certificate": {
+			ctx:      withTLS(nil),
+			wantCode: codes.Unauthenticated,
+		},
+		"no tls": {
+			ctx:         context.Background(),
+			wantSubject: "",
+		},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			fn := authenticate(&Config{Authenticators: []Authenticator{tc.mtls}})
+			ctx, err := fn(tc.ctx)
+			if got := status.Code(err); got != tc.wantCode {
+				t.Fatalf("got code: %s, want: %s", got, tc.wantCode)
+			}
+			if err != nil {
+				return
+			}
+
+			if got := subject(ctx); got != tc.wantSubject {
+				t.Fatalf("got subject: %q, want: %q", got, tc.wantSubject)
+			}
+		})
+	}
+}
+
+func TestAudit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	auditLog, err := audit.New(dir, audit.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auditLog.Close()
+
+	rootClient, nobodyClient, _, teardown := setupTests(t, func(c *Config) {
+		c.Audit = auditLog
+	})
+	defer teardown()
+
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		_, err := rootClient.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the stream is recorded with the range of offsets it read.
+	streamCtx, cancel := context.WithCancel(ctx)
+	stream, err := rootClient.ConsumeStream(streamCtx, &api.ConsumeRequest{Offset: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := stream.Recv(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the stream shows up as started while it's still running.
+	res, err := rootClient.QueryAudit(ctx, &api.QueryAuditRequest{
+		Subject: "root",
+		Action:  consumeAction,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Entries) != 1 || !res.Entries[0].Started || res.Entries[0].HasOffsets {
+		t.Fatalf("got entries of the running stream: %v", res.Entries)
+	}
+	cancel()
+
+	_, err = nobodyClient.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+	if got, want := status.Code(err), codes.PermissionDenied; got != want {
+		t.Fatalf("got code: %s, want: %s", got, want)
+	}
+
+	_, err = nobodyClient.QueryAudit(ctx, &api.QueryAuditRequest{})
+	if got, want := status.Code(err), codes.PermissionDenied; got != want {
+		t.Fatalf("got code: %s, want: %s", got, want)
+	}
+
+	res, err = rootClient.QueryAudit(ctx, &api.QueryAuditRequest{Action: produceAction})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(res.Entries) != 2 {
+		t.Fatalf("got %d produce entries, want: 2", len(res.Entries))
+	}
+	for i, entry := range res.Entries {
+		if entry.Subject != "root" || entry.Result != codes.OK.String() {
+			t.Fatalf("got entry: %v", entry)
+		}
+		if !entry.HasOffsets || entry.FirstOffset != uint64(i) || entry.LastOffset != uint64(i) {
+			t.Fatalf("got offsets: %d-%d, want: %d", entry.FirstOffset, entry.LastOffset, i)
+		}
+	}
+
+	res, err = rootClient.QueryAudit(ctx, &api.QueryAuditRequest{
+		Subject: "nobody",
+		Result:  codes.PermissionDenied.String(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(res.Entries) != 2 {
+		t.Fatalf("got %d denied entries, want: 2", len(res.Entries))
+	}
+	if res.Entries[0].Action != consumeAction || res.Entries[1].Object != auditObject {
+		t.Fatalf("got entries: %v", res.Entries)
+	}
+
+	// the stream is recorded once the server notices it was cancelled.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		res, err = rootClient.QueryAudit(ctx, &api.QueryAuditRequest{
+			Subject: "root",
+			Action:  consumeAction,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Entries) == 2 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("consume stream wasn't recorded")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if entry := res.Entries[1]; entry.Started || entry.FirstOffset != 0 || entry.LastOffset != 1 {
+		t.Fatalf("got offsets: %d-%d, want: 0-1", entry.FirstOffset, entry.LastOffset)
+	}
+}
+
+func TestQuotas(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quota-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "quotas.json")
+	writeQuotas := func(config quota.Config) {
+		b, err := json.Marshal(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeQuotas(quota.Config{
+		Subjects: map[string]quota.Limits{
+			"root": {produceAction: {RequestsPerSecond: 0.1, RequestBurst: 1}},
+		},
+	})
+
+	quotas, err := quota.New(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, _, _, teardown := setupTests(t, func(c *Config) {
+		c.Quotas = quotas
+	})
+	defer teardown()
+
+	ctx := context.Background()
+	produce := func() error {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: bytes.Repeat([]byte("a"), 100)},
+		})
+		return err
+	}
+	consume := func() error {
+		_, err := client.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+		return err
+	}
+
+	if err := produce(); err != nil {
+		t.Fatal(err)
+	}
+
+	err = produce()
+	st := status.Convert(err)
+	if st.Code() != codes.ResourceExhausted {
+		t.Fatalf("got code: %s, want: %s", st.Code(), codes.ResourceExhausted)
+	}
+
+	var retryDelay time.Duration
+	for _, detail := range st.Details() {
+		if info, ok := detail.(*errdetails.RetryInfo); ok {
+			retryDelay = info.RetryDelay.AsDuration()
+		}
+	}
+	if retryDelay <= 0 {
+		t.Fatalf("got retry delay: %s, want a positive one", retryDelay)
+	}
+
+	// produce is unlimited after reloading, while reading the 100 byte
+	// record puts consume over its quota.
+	writeQuotas(quota.Config{
+		Default: quota.Limits{consumeAction: {BytesPerSecond: 10}},
+	})
+	if err := quotas.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := produce(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := consume(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := status.Code(consume()), codes.ResourceExhausted; got != want {
+		t.Fatalf("got code: %s, want: %s", got, want)
+	}
+}
@@ -0,0 +1,279 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"go.opencensus.io/trace"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/instrumentation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	oteltrace "go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// DefaultOTLPInterval is how often batches of spans are sent.
+	DefaultOTLPInterval = 5 * time.Second
+	// DefaultOTLPBatchSize is the most spans sent in one request, a full
+	// batch is sent without waiting for the interval.
+	DefaultOTLPBatchSize = 512
+
+	// queueSize bounds the spans waiting to be batched. Spans ended while
+	// it's full are dropped rather than slowing the calls they trace down.
+	queueSize = 4096
+
+	otlpTracesPath = "/v1/traces"
+	otlpTimeout    = 10 * time.Second
+)
+
+// OTLPConfig configures an OTLPExporter.
+type OTLPConfig struct {
+	// Endpoint is the collector's base URL, such as http://localhost:4318.
+	// Spans are posted to its /v1/traces path.
+	Endpoint string
+	// Headers are sent with every request, for collectors that require
+	// authentication.
+	Headers map[string]string
+	// ServiceName and ServiceInstance identify the process the spans are
+	// from.
+	ServiceName     string
+	ServiceInstance string
+	Interval        time.Duration
+	BatchSize       int
+	// OnError is called with the errors of sending spans, which happens in
+	// the background. They're dropped if it's nil.
+	OnError func(error)
+}
+
+// OTLPExporter sends the spans OpenCensus records to an OpenTelemetry
+// collector with OTLP over HTTP, converting them to OpenTelemetry spans for
+// the OpenTelemetry exporter, which batches and sends them in the
+// background.
+type OTLPExporter struct {
+	processor sdktrace.SpanProcessor
+	resource  *resource.Resource
+}
+
+var _ trace.Exporter = (*OTLPExporter)(nil)
+
+// NewOTLPExporter starts an exporter sending to the config's endpoint. It
+// needs to be registered with trace.RegisterExporter to receive spans, and
+// closed to send the last of them.
+func NewOTLPExporter(config OTLPConfig) (*OTLPExporter, error) {
+	u, err := url.Parse(config.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("parsing OTLP endpoint: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("OTLP endpoint isn't an http or https URL: %q", config.Endpoint)
+	}
+
+	if config.Interval == 0 {
+		config.Interval = DefaultOTLPInterval
+	}
+	if config.BatchSize == 0 {
+		config.BatchSize = DefaultOTLPBatchSize
+	}
+
+	opts := []otlptracehttp.Option{
+		otlptracehttp.WithEndpoint(u.Host),
+		otlptracehttp.WithURLPath(strings.TrimSuffix(u.Path, "/") + otlpTracesPath),
+		otlptracehttp.WithHeaders(config.Headers),
+		otlptracehttp.WithTimeout(otlpTimeout),
+	}
+	if u.Scheme == "http" {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := []attribute.KeyValue{semconv.ServiceNameKey.String(config.ServiceName)}
+	if config.ServiceInstance != "" {
+		attrs = append(attrs, semconv.ServiceInstanceIDKey.String(config.ServiceInstance))
+	}
+
+	return &OTLPExporter{
+		processor: sdktrace.NewBatchSpanProcessor(
+			&reportingExporter{SpanExporter: exporter, onError: config.OnError},
+			sdktrace.WithBatchTimeout(config.Interval),
+			sdktrace.WithMaxExportBatchSize(config.BatchSize),
+			sdktrace.WithMaxQueueSize(queueSize),
+		),
+		resource: resource.NewWithAttributes(semconv.SchemaURL, attrs...),
+	}, nil
+}
+
+// ExportSpan queues the span to be sent with the next batch.
+func (e *OTLPExporter) ExportSpan(sd *trace.SpanData) {
+	e.processor.OnEnd(&span{data: sd, resource: e.resource})
+}
+
+// Flush sends the queued spans and waits for them to be sent. Failing to send
+// them is reported to OnError.
+func (e *OTLPExporter) Flush() error {
+	return e.processor.ForceFlush(context.Background())
+}
+
+// Close sends the queued spans and stops the exporter. Spans exported after
+// it's closed are dropped, so it should be unregistered first.
+func (e *OTLPExporter) Close() error {
+	return e.processor.Shutdown(context.Background())
+}
+
+// reportingExporter reports the errors of exporting to the config's OnError,
+// rather than the batch span processor reporting them to OpenTelemetry's
+// global error handler.
+type reportingExporter struct {
+	sdktrace.SpanExporter
+	onError func(error)
+}
+
+func (e *reportingExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	e.report(e.SpanExporter.ExportSpans(ctx, spans))
+	return nil
+}
+
+func (e *reportingExporter) Shutdown(ctx context.Context) error {
+	e.report(e.SpanExporter.Shutdown(ctx))
+	return nil
+}
+
+func (e *reportingExporter) report(err error) {
+	if err != nil && e.onError != nil {
+		e.onError(err)
+	}
+}
+
+// span is an OpenCensus span read as the OpenTelemetry span it would have
+// been. ReadOnlySpan can only be implemented by embedding it, the embedded
+// span is always nil.
+type span struct {
+	sdktrace.ReadOnlySpan
+	data     *trace.SpanData
+	resource *resource.Resource
+}
+
+func (s *span) Name() string { return s.data.Name }
+
+func (s *span) SpanContext() oteltrace.SpanContext {
+	return spanContext(s.data.TraceID, s.data.SpanID, s.data.TraceOptions)
+}
+
+func (s *span) Parent() oteltrace.SpanContext {
+	if s.data.ParentSpanID == (trace.SpanID{}) {
+		return oteltrace.SpanContext{}
+	}
+	return spanContext(s.data.TraceID, s.data.ParentSpanID, s.data.TraceOptions)
+}
+
+func (s *span) SpanKind() oteltrace.SpanKind {
+	switch s.data.SpanKind {
+	case trace.SpanKindServer:
+		return oteltrace.SpanKindServer
+	case trace.SpanKindClient:
+		return oteltrace.SpanKindClient
+	default:
+		return oteltrace.SpanKindInternal
+	}
+}
+
+func (s *span) StartTime() time.Time { return s.data.StartTime }
+
+func (s *span) EndTime() time.Time { return s.data.EndTime }
+
+func (s *span) Attributes() []attribute.KeyValue { return attributes(s.data.Attributes) }
+
+func (s *span) Links() []sdktrace.Link {
+	var links []sdktrace.Link
+	for _, l := range s.data.Links {
+		links = append(links, sdktrace.Link{
+			SpanContext: spanContext(l.TraceID, l.SpanID, 0),
+			Attributes:  attributes(l.Attributes),
+		})
+	}
+	return links
+}
+
+func (s *span) Events() []sdktrace.Event {
+	var events []sdktrace.Event
+	for _, a := range s.data.Annotations {
+		events = append(events, sdktrace.Event{
+			Name:       a.Message,
+			Attributes: attributes(a.Attributes),
+			Time:       a.Time,
+		})
+	}
+	return events
+}
+
+// Status reports OpenCensus codes, which are gRPC ones, as errors unless OK.
+func (s *span) Status() sdktrace.Status {
+	if s.data.Code == 0 {
+		return sdktrace.Status{}
+	}
+	return sdktrace.Status{Code: codes.Error, Description: s.data.Message}
+}
+
+func (s *span) InstrumentationScope() instrumentation.Scope {
+	return instrumentation.Scope{Name: "go.opencensus.io/trace"}
+}
+
+func (s *span) InstrumentationLibrary() instrumentation.Library {
+	return s.InstrumentationScope()
+}
+
+func (s *span) Resource() *resource.Resource { return s.resource }
+
+func (s *span) DroppedAttributes() int { return s.data.DroppedAttributeCount }
+
+func (s *span) DroppedLinks() int { return s.data.DroppedLinkCount }
+
+func (s *span) DroppedEvents() int { return s.data.DroppedAnnotationCount }
+
+func (s *span) ChildSpanCount() int { return s.data.ChildSpanCount }
+
+func spanContext(traceID trace.TraceID, spanID trace.SpanID, options trace.TraceOptions) oteltrace.SpanContext {
+	return oteltrace.NewSpanContext(oteltrace.SpanContextConfig{
+		TraceID:    oteltrace.TraceID(traceID),
+		SpanID:     oteltrace.SpanID(spanID),
+		TraceFlags: oteltrace.TraceFlags(options),
+	})
+}
+
+// attributes converts attributes sorted by key, to keep requests
+// deterministic.
+func attributes(attrs map[string]interface{}) []attribute.KeyValue {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var kvs []attribute.KeyValue
+	for _, k := range keys {
+		switch v := attrs[k].(type) {
+		case bool:
+			kvs = append(kvs, attribute.Bool(k, v))
+		case int64:
+			kvs = append(kvs, attribute.Int64(k, v))
+		case float64:
+			kvs = append(kvs, attribute.Float64(k, v))
+		case string:
+			kvs = append(kvs, attribute.String(k, v))
+		default:
+			kvs = append(kvs, attribute.String(k, fmt.Sprint(v)))
+		}
+	}
+	return kvs
+}
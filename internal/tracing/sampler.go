@@ -0,0 +1,46 @@
+// Package tracing configures how calls are sampled for tracing and exports
+// the sampled spans.
+package tracing
+
+import (
+	"strings"
+
+	"go.opencensus.io/trace"
+)
+
+// DefaultSampleRate is the fraction of calls traced unless configured
+// otherwise.
+const DefaultSampleRate = 0.5
+
+// DefaultAlwaysSampled are the methods traced regardless of the sample rate,
+// produces are rare enough and interesting enough to always trace.
+var DefaultAlwaysSampled = []string{
+	"/log.v1.Log/Produce",
+	"/log.v1.Log/ProduceStream",
+}
+
+// Sampler traces the rate's fraction of spans, along with every span of the
+// always sampled gRPC methods, named like /log.v1.Log/Produce. A rate of zero
+// or less only traces those, for callers that want no sampling beyond them;
+// callers defaulting a zero rate, like the agent, take a negative rate to mean
+// that. Spans whose parent was sampled are sampled too, so traces from
+// callers that sampled them are kept whole.
+func Sampler(rate float64, always []string) trace.Sampler {
+	sampled := make(map[string]bool, len(always))
+	for _, method := range always {
+		sampled[spanName(method)] = true
+	}
+
+	probability := trace.ProbabilitySampler(rate)
+	return func(p trace.SamplingParameters) trace.SamplingDecision {
+		if p.ParentContext.IsSampled() || sampled[p.Name] {
+			return trace.SamplingDecision{Sample: true}
+		}
+		return probability(p)
+	}
+}
+
+// spanName returns the name ocgrpc gives the spans of a gRPC method.
+func spanName(method string) string {
+	return strings.Replace(strings.TrimPrefix(method, "/"), "/", ".", -1)
+}
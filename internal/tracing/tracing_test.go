@@ -0,0 +1,213 @@
+package tracing
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opencensus.io/trace"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestSampler(t *testing.T) {
+	sampled := trace.SpanContext{TraceOptions: 1}
+
+	for scenario, tc := range map[string]struct {
+		rate   float64
+		params trace.SamplingParameters
+		want   bool
+	}{
+		"always sampled method": {
+			rate:   -1,
+			params: trace.SamplingParameters{Name: "log.v1.Log.Produce"},
+			want:   true,
+		},
+		"sampled parent": {
+			rate:   -1,
+			params: trace.SamplingParameters{Name: "log.v1.Log.Consume", ParentContext: sampled},
+			want:   true,
+		},
+		"never sampled": {
+			rate:   -1,
+			params: trace.SamplingParameters{Name: "log.v1.Log.Consume"},
+			want:   false,
+		},
+		"zero rate": {
+			rate:   0,
+			params: trace.SamplingParameters{Name: "log.v1.Log.Consume"},
+			want:   false,
+		},
+		"always sampled rate": {
+			rate:   1,
+			params: trace.SamplingParameters{Name: "log.v1.Log.Consume"},
+			want:   true,
+		},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			got := Sampler(tc.rate, DefaultAlwaysSampled)(tc.params).Sample
+			if got != tc.want {
+				t.Fatalf("got sampled: %t, want: %t", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests []*coltracepb.ExportTraceServiceRequest
+	)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" {
+			t.Errorf("got path: %s, want: /v1/traces", r.URL.Path)
+		}
+		if got := r.Header.Get("Authorization"); got != "Bearer token" {
+			t.Errorf("got authorization: %q, want: %q", got, "Bearer token")
+		}
+
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+
+		req := &coltracepb.ExportTraceServiceRequest{}
+		if err := proto.Unmarshal(b, req); err != nil {
+			t.Error(err)
+		}
+
+		mu.Lock()
+		requests = append(requests, req)
+		mu.Unlock()
+	}))
+	defer collector.Close()
+
+	exporter, err := NewOTLPExporter(OTLPConfig{
+		Endpoint:        collector.URL,
+		Headers:         map[string]string{"Authorization": "Bearer token"},
+		ServiceName:     "dilog",
+		ServiceInstance: "0",
+		BatchSize:       2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer exporter.Close()
+
+	start := time.Unix(1, 0)
+	for i := 0; i < 3; i++ {
+		exporter.ExportSpan(&trace.SpanData{
+			SpanContext: trace.SpanContext{
+				TraceID:      trace.TraceID{1},
+				SpanID:       trace.SpanID{byte(i + 1)},
+				TraceOptions: 1,
+			},
+			ParentSpanID: trace.SpanID{9},
+			SpanKind:     trace.SpanKindServer,
+			Name:         "log.v1.Log.Produce",
+			StartTime:    start,
+			EndTime:      start.Add(time.Second),
+			Attributes:   map[string]interface{}{"offset": int64(i)},
+			Status:       trace.Status{Code: 5, Message: "not found"},
+			Links:        []trace.Link{{TraceID: trace.TraceID{2}, SpanID: trace.SpanID{3}}},
+		})
+	}
+	if err := exporter.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	// three spans in batches of two.
+	if len(requests) != 2 {
+		t.Fatalf("got %d requests, want: 2", len(requests))
+	}
+
+	var spans []*tracepb.Span
+	for _, req := range requests {
+		for _, rs := range req.ResourceSpans {
+			resource := map[string]string{}
+			for _, kv := range rs.Resource.Attributes {
+				resource[kv.Key] = kv.Value.GetStringValue()
+			}
+			if resource["service.name"] != "dilog" || resource["service.instance.id"] != "0" {
+				t.Fatalf("got resource: %v", resource)
+			}
+
+			for _, ss := range rs.ScopeSpans {
+				spans = append(spans, ss.Spans...)
+			}
+		}
+	}
+
+	if len(spans) != 3 {
+		t.Fatalf("got %d spans, want: 3", len(spans))
+	}
+
+	got := spans[2]
+	if !bytes.Equal(got.TraceId, []byte{1, 15: 0}) ||
+		!bytes.Equal(got.SpanId, []byte{3, 7: 0}) ||
+		!bytes.Equal(got.ParentSpanId, []byte{9, 7: 0}) {
+		t.Fatalf("got ids: %x %x %x", got.TraceId, got.SpanId, got.ParentSpanId)
+	}
+	if got.Name != "log.v1.Log.Produce" || got.Kind != tracepb.Span_SPAN_KIND_SERVER {
+		t.Fatalf("got span: %s of kind %s", got.Name, got.Kind)
+	}
+	if got.StartTimeUnixNano != 1e9 || got.EndTimeUnixNano != 2e9 {
+		t.Fatalf("got times: %d-%d", got.StartTimeUnixNano, got.EndTimeUnixNano)
+	}
+	if len(got.Attributes) != 1 || got.Attributes[0].Key != "offset" || got.Attributes[0].Value.GetIntValue() != 2 {
+		t.Fatalf("got attributes: %v", got.Attributes)
+	}
+	if len(got.Links) != 1 || !bytes.Equal(got.Links[0].TraceId, []byte{2, 15: 0}) || !bytes.Equal(got.Links[0].SpanId, []byte{3, 7: 0}) {
+		t.Fatalf("got links: %v", got.Links)
+	}
+	if got.Status.Code != tracepb.Status_STATUS_CODE_ERROR || got.Status.Message != "not found" {
+		t.Fatalf("got status: %v", got.Status)
+	}
+}
+
+func TestOTLPExporterErrors(t *testing.T) {
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer collector.Close()
+
+	var (
+		mu   sync.Mutex
+		errs []error
+	)
+	exporter, err := NewOTLPExporter(OTLPConfig{
+		Endpoint: collector.URL,
+		OnError: func(err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			errs = append(errs, err)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer exporter.Close()
+
+	exporter.ExportSpan(&trace.SpanData{
+		SpanContext: trace.SpanContext{TraceID: trace.TraceID{1}, SpanID: trace.SpanID{1}, TraceOptions: 1},
+		Name:        "log.v1.Log.Produce",
+	})
+	if err := exporter.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the failed export is reported to the exporter's handler.
+	mu.Lock()
+	defer mu.Unlock()
+	if len(errs) != 1 {
+		t.Fatalf("got %d errors, want: 1", len(errs))
+	}
+}
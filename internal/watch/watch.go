@@ -0,0 +1,93 @@
+// Package watch calls back whenever files change, for reloading
+// configuration without restarting.
+package watch
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+)
+
+// Delay batches the several events a change causes, such as editors
+// writing a file in steps or a certificate and its key being renewed one
+// after the other, into a single call.
+const Delay = 100 * time.Millisecond
+
+// Watcher calls its function whenever one of its files changes, until it's
+// closed.
+type Watcher struct {
+	fs     *fsnotify.Watcher
+	files  map[string]bool
+	logger *zap.Logger
+	fn     func()
+	done   chan struct{}
+}
+
+// Files starts watching the files, calling fn once they've stopped changing
+// for Delay. Empty names are skipped. The files' directories are watched
+// rather than the files, so that files replaced by renaming over them keep
+// being watched. Errors watching them are logged to logger.
+func Files(files []string, logger *zap.Logger, fn func()) (*Watcher, error) {
+	fs, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	w := &Watcher{
+		fs:     fs,
+		files:  make(map[string]bool),
+		logger: logger,
+		fn:     fn,
+		done:   make(chan struct{}),
+	}
+
+	for _, file := range files {
+		if file == "" {
+			continue
+		}
+
+		w.files[filepath.Clean(file)] = true
+		if err := fs.Add(filepath.Dir(file)); err != nil {
+			fs.Close()
+			return nil, err
+		}
+	}
+
+	go w.watch()
+
+	return w, nil
+}
+
+func (w *Watcher) watch() {
+	defer close(w.done)
+
+	var changed <-chan time.Time
+	for {
+		select {
+		case event, ok := <-w.fs.Events:
+			if !ok {
+				return
+			}
+			if w.files[filepath.Clean(event.Name)] {
+				changed = time.After(Delay)
+			}
+		case err, ok := <-w.fs.Errors:
+			if !ok {
+				return
+			}
+			w.logger.Error("failed to watch files", zap.Error(err))
+		case <-changed:
+			changed = nil
+			w.fn()
+		}
+	}
+}
+
+// Close stops watching the files, waiting for a call in progress to return.
+func (w *Watcher) Close() error {
+	err := w.fs.Close()
+	<-w.done
+	return err
+}